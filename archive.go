@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveConfig is the retention policy of the uploaded recordings.
+// Files older than CompressAfter are gzipped, files older than MaxAge are deleted,
+// and the oldest files are deleted while the archive is bigger than MaxSizeMB. 0 disables a rule.
+type ArchiveConfig struct {
+	CompressAfter time.Duration `yaml:"compress_after"`
+	MaxAge        time.Duration `yaml:"max_age"`
+	MaxSizeMB     int64         `yaml:"max_size_mb"`
+	Interval      time.Duration `yaml:"interval"` // janitor 运行间隔
+}
+
+// archive stores every upload attempt under its own key prefix: <address>/<yyyy-mm-dd>/<job id>/.
+type archive struct {
+	store AudioStore
+	c     ArchiveConfig
+}
+
+func newArchive(store AudioStore, c ArchiveConfig) *archive {
+	return &archive{store: store, c: c}
+}
+
+// safeName escapes s into a single key element: letters, digits, - and _ are kept and the other bytes become %XX,
+// so different names never share an element and it is never "." or "..".
+func safeName(s string) string {
+	if s == "" {
+		// 转义的结果不会是单独的 %
+		return "%"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func archiveKey(address, jobId string, t time.Time, name string) string {
+	return strings.Join([]string{safeName(address), t.Format("2006-01-02"), safeName(jobId), name}, "/")
+}
+
+// save writes data as name of the job.
+func (a *archive) save(ctx context.Context, address, jobId string, t time.Time, name string, data []byte) error {
+	return a.store.Put(ctx, archiveKey(address, jobId, t, name), data)
+}
+
+// saveResult writes r as result.json of the job.
+func (a *archive) saveResult(ctx context.Context, address, jobId string, t time.Time, r *UploadResult) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return a.save(ctx, address, jobId, t, "result.json", data)
+}
+
+// janitor applies the retention policy every interval.
+func (a *archive) janitor() {
+	if a.c.Interval <= 0 {
+		return
+	}
+	for {
+		err := a.clean(context.Background(), time.Now())
+		if err != nil {
+			log.Println("archive janitor error:", err)
+		}
+		time.Sleep(a.c.Interval)
+	}
+}
+
+// objectTime is the time the retention of o counts from.
+// Compressing rewrites the object, so the end of the day in the key is used if it is earlier than the modification time.
+func objectTime(o audioObject) time.Time {
+	parts := strings.Split(o.Key, "/")
+	if len(parts) > 1 {
+		day, err := time.ParseInLocation("2006-01-02", parts[1], time.Local)
+		if err == nil && day.Add(24*time.Hour).Before(o.ModTime) {
+			return day.Add(24 * time.Hour)
+		}
+	}
+	return o.ModTime
+}
+
+func (a *archive) clean(ctx context.Context, now time.Time) error {
+	objs, err := a.store.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	var kept []audioObject
+	for _, o := range objs {
+		age := now.Sub(objectTime(o))
+		switch {
+		case strings.HasSuffix(o.Key, ".pcm"):
+			// 旧版本 ffmpeg 转换留下的中间文件
+			err = a.store.Delete(ctx, o.Key)
+		case a.c.MaxAge > 0 && age > a.c.MaxAge:
+			err = a.store.Delete(ctx, o.Key)
+		case a.c.CompressAfter > 0 && age > a.c.CompressAfter && !strings.HasSuffix(o.Key, ".gz"):
+			var gz audioObject
+			gz, err = a.compress(ctx, o)
+			if err != nil {
+				log.Println("compress", o.Key, "error:", err)
+				kept = append(kept, o)
+				continue
+			}
+			kept = append(kept, gz)
+		default:
+			kept = append(kept, o)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.c.MaxSizeMB > 0 {
+		// 超过总大小时从最旧的文件开始删除
+		sort.Slice(kept, func(i, j int) bool { return objectTime(kept[i]).Before(objectTime(kept[j])) })
+		var total int64
+		for _, o := range kept {
+			total += o.Size
+		}
+		for _, o := range kept {
+			if total <= a.c.MaxSizeMB<<20 {
+				break
+			}
+			err := a.store.Delete(ctx, o.Key)
+			if err != nil {
+				log.Println("remove", o.Key, "error:", err)
+				continue
+			}
+			total -= o.Size
+		}
+	}
+	return nil
+}
+
+// compress gzips o to o.Key + ".gz" and deletes o.
+func (a *archive) compress(ctx context.Context, o audioObject) (audioObject, error) {
+	b, err := a.store.Get(ctx, o.Key)
+	if err != nil {
+		return o, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	err = zw.Close()
+	if err != nil {
+		return o, err
+	}
+	gz := audioObject{Key: o.Key + ".gz", Size: int64(buf.Len()), ModTime: o.ModTime}
+	err = a.store.Put(ctx, gz.Key, buf.Bytes())
+	if err != nil {
+		return o, err
+	}
+	return gz, a.store.Delete(ctx, o.Key)
+}
+
+// reviewObject is one recording listed by /review.
+type reviewObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	URL     string
+}
+
+// reviewHandler lists the archived recordings of an address (and job) with signed download urls.
+func (s *server) reviewHandler(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if s.reviewToken == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.reviewToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		http.Error(w, "Missing address parameter", http.StatusBadRequest)
+		return
+	}
+	job := r.URL.Query().Get("job")
+	objs, err := s.archive.store.List(r.Context(), safeName(address)+"/")
+	if err != nil {
+		log.Println("list audio error:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := []reviewObject{}
+	for _, o := range objs {
+		if parts := strings.Split(o.Key, "/"); job != "" && (len(parts) < 3 || parts[2] != safeName(job)) {
+			continue
+		}
+		u, err := s.archive.store.SignedURL(o.Key, s.urlExpiry)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, reviewObject{Key: o.Key, Size: o.Size, ModTime: o.ModTime, URL: u})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
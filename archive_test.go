@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSafeName(t *testing.T) {
+	tests := []struct{ s, want string }{
+		{"0xAbc-1_2", "0xAbc-1_2"},
+		{"a.b", "a%2Eb"},
+		{"a_b", "a_b"},
+		{"a%2Eb", "a%252Eb"},
+		{"..", "%2E%2E"},
+		{"a/b", "a%2Fb"},
+		{"芝", "%E8%8A%9D"},
+		{"", "%"},
+	}
+	seen := map[string]string{}
+	for _, tt := range tests {
+		got := safeName(tt.s)
+		if got != tt.want {
+			t.Errorf("safeName(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+		if s, ok := seen[got]; ok {
+			t.Errorf("%q and %q are both %q", s, tt.s, got)
+		}
+		seen[got] = tt.s
+		if tt.s != "" {
+			if s, err := url.PathUnescape(got); err != nil || s != tt.s {
+				t.Errorf("unescape %q = %q %v", got, s, err)
+			}
+		}
+	}
+}
+
+// putAged writes key to the fs store of dir, modified at t.
+func putAged(t *testing.T, store *fsAudioStore, key string, data []byte, mt time.Time) {
+	t.Helper()
+	if err := store.Put(context.Background(), key, data); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := store.path(key)
+	if err := os.Chtimes(p, mt, mt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func storeKeys(t *testing.T, store AudioStore) []string {
+	t.Helper()
+	objs, err := store.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, o := range objs {
+		keys = append(keys, o.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestArchiveClean(t *testing.T) {
+	store := newFSAudioStore(t.TempDir(), "", "")
+	a := newArchive(store, ArchiveConfig{CompressAfter: 24 * time.Hour, MaxAge: 30 * 24 * time.Hour})
+	now := time.Now()
+	put := func(name string, age time.Duration) string {
+		mt := now.Add(-age)
+		key := archiveKey("0xabc", name, mt, "upload.wav")
+		putAged(t, store, key, bytes.Repeat([]byte(name), 100), mt)
+		return key
+	}
+	fresh := put("fresh", time.Hour)
+	old := put("old", 2*24*time.Hour)
+	expired := put("expired", 40*24*time.Hour)
+	pcm := archiveKey("0xabc", "fresh", now, "upload.pcm")
+	putAged(t, store, pcm, []byte("pcm"), now)
+
+	if err := a.clean(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{fresh, old + ".gz"}
+	sort.Strings(want)
+	if got := storeKeys(t, store); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("after clean %v, want %v (expired %s, pcm %s)", got, want, expired, pcm)
+	}
+	b, err := store.Get(context.Background(), old+".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(zr); !bytes.Equal(b, bytes.Repeat([]byte("old"), 100)) {
+		t.Errorf("gzipped content %q", b)
+	}
+
+	// 压缩后的文件按 key 里的日期计算年龄，不会因为改写而变新
+	if err := a.clean(context.Background(), now.Add(29*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := storeKeys(t, store); len(got) != 1 || got[0] != fresh+".gz" {
+		t.Errorf("after 29 days %v", got)
+	}
+}
+
+func TestArchiveMaxSize(t *testing.T) {
+	store := newFSAudioStore(t.TempDir(), "", "")
+	a := newArchive(store, ArchiveConfig{MaxSizeMB: 1})
+	now := time.Now()
+	r := rand.New(rand.NewSource(1))
+	var keys []string
+	for i, name := range []string{"j1", "j2", "j3"} {
+		mt := now.Add(time.Duration(i-3) * time.Hour)
+		data := make([]byte, 600<<10)
+		r.Read(data)
+		key := archiveKey("0xabc", name, mt, "upload.wav")
+		putAged(t, store, key, data, mt)
+		keys = append(keys, key)
+	}
+	if err := a.clean(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	// 1.8 MB 超过 1 MB，从最旧的开始删
+	if got := storeKeys(t, store); len(got) != 1 || got[0] != keys[2] {
+		t.Errorf("after clean %v, want %s", got, keys[2])
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// speechRate is the sample rate expected by iat and the voiceprint api.
+const speechRate = 16000
+
+var (
+	errNotWav        = errors.New("not a wav file")
+	errInvalidFormat = errors.New("invalid audio format")
+)
+
+// The sample rates accepted from uploads, a tiny rate makes resampling to speechRate explode.
+const (
+	minSampleRate = 4000
+	maxSampleRate = 192000
+)
+
+// checkFormat rejects channel counts and sample rates no recorder produces.
+func checkFormat(channels, rate int) error {
+	if channels <= 0 || channels > 8 {
+		return fmt.Errorf("%w: channels %d", errInvalidFormat, channels)
+	}
+	if rate < minSampleRate || rate > maxSampleRate {
+		return fmt.Errorf("%w: sample rate %d is not in %d-%d Hz", errInvalidFormat, rate, minSampleRate, maxSampleRate)
+	}
+	return nil
+}
+
+// pcmAudio is decoded audio, samples are interleaved by channel and scaled to [-1, 1].
+type pcmAudio struct {
+	rate     int
+	channels int
+	samples  []float32
+	srcRate  int // sample rate of the upload before resampling, 0 if unknown
+}
+
+// duration returns the length of a in seconds.
+func (a *pcmAudio) duration() float64 {
+	if a.rate == 0 || a.channels == 0 {
+		return 0
+	}
+	return float64(len(a.samples)/a.channels) / float64(a.rate)
+}
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xfffe
+)
+
+// decodeWav decodes RIFF/WAVE audio with integer (8, 16, 24, 32 bits) or float (32, 64 bits) samples.
+func decodeWav(b []byte) (*pcmAudio, error) {
+	if len(b) < 12 || string(b[0:4]) != "RIFF" || string(b[8:12]) != "WAVE" {
+		return nil, errNotWav
+	}
+	var format, channels, bits int
+	var rate int
+	var data []byte
+	for p := 12; p+8 <= len(b); {
+		id := string(b[p : p+4])
+		size := int(binary.LittleEndian.Uint32(b[p+4 : p+8]))
+		p += 8
+		end := p + size
+		if end > len(b) {
+			// 录音程序中断时 data 块长度可能不对，取剩余部分
+			end = len(b)
+		}
+		chunk := b[p:end]
+		switch id {
+		case "fmt ":
+			if len(chunk) < 16 {
+				return nil, errors.New("wav: short fmt chunk")
+			}
+			format = int(binary.LittleEndian.Uint16(chunk[0:2]))
+			channels = int(binary.LittleEndian.Uint16(chunk[2:4]))
+			rate = int(binary.LittleEndian.Uint32(chunk[4:8]))
+			bits = int(binary.LittleEndian.Uint16(chunk[14:16]))
+			if format == wavFormatExtensible && len(chunk) >= 26 {
+				// SubFormat GUID 的前两个字节就是实际格式
+				format = int(binary.LittleEndian.Uint16(chunk[24:26]))
+			}
+		case "data":
+			data = chunk
+		}
+		// 块长度为奇数时有一个填充字节
+		p = end + size%2
+	}
+	if format == 0 {
+		return nil, errors.New("wav: missing fmt chunk")
+	}
+	if data == nil {
+		return nil, errors.New("wav: missing data chunk")
+	}
+	if err := checkFormat(channels, rate); err != nil {
+		return nil, fmt.Errorf("wav: %w", err)
+	}
+
+	a := &pcmAudio{rate: rate, channels: channels}
+	width := bits / 8
+	if width == 0 || bits%8 != 0 {
+		return nil, fmt.Errorf("wav: unsupported bits per sample %d", bits)
+	}
+	n := len(data) / width
+	a.samples = make([]float32, n)
+	switch {
+	case format == wavFormatPCM && bits == 8:
+		for i := 0; i < n; i++ {
+			a.samples[i] = (float32(data[i]) - 128) / 128
+		}
+	case format == wavFormatPCM && bits == 16:
+		for i := 0; i < n; i++ {
+			a.samples[i] = float32(int16(binary.LittleEndian.Uint16(data[i*2:]))) / 32768
+		}
+	case format == wavFormatPCM && bits == 24:
+		for i := 0; i < n; i++ {
+			v := int32(data[i*3]) | int32(data[i*3+1])<<8 | int32(int8(data[i*3+2]))<<16
+			a.samples[i] = float32(v) / (1 << 23)
+		}
+	case format == wavFormatPCM && bits == 32:
+		for i := 0; i < n; i++ {
+			a.samples[i] = float32(int32(binary.LittleEndian.Uint32(data[i*4:]))) / (1 << 31)
+		}
+	case format == wavFormatFloat && bits == 32:
+		for i := 0; i < n; i++ {
+			a.samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+		}
+	case format == wavFormatFloat && bits == 64:
+		for i := 0; i < n; i++ {
+			a.samples[i] = float32(math.Float64frombits(binary.LittleEndian.Uint64(data[i*8:])))
+		}
+	default:
+		return nil, fmt.Errorf("wav: unsupported format %d with %d bits", format, bits)
+	}
+	// 去掉不完整的最后一帧
+	a.samples = a.samples[:len(a.samples)/channels*channels]
+	return a, nil
+}
+
+// mono mixes all channels down to one.
+func (a *pcmAudio) mono() *pcmAudio {
+	if a.channels == 1 {
+		return a
+	}
+	n := len(a.samples) / a.channels
+	m := &pcmAudio{rate: a.rate, channels: 1, samples: make([]float32, n), srcRate: a.srcRate}
+	for i := 0; i < n; i++ {
+		var sum float32
+		for c := 0; c < a.channels; c++ {
+			sum += a.samples[i*a.channels+c]
+		}
+		m.samples[i] = sum / float32(a.channels)
+	}
+	return m
+}
+
+// resampleTaps is the half width of the windowed sinc filter.
+const resampleTaps = 16
+
+// resample converts mono audio to rate with a windowed sinc filter,
+// the cutoff is lowered when downsampling to avoid aliasing.
+func (a *pcmAudio) resample(rate int) *pcmAudio {
+	if a.rate == rate || a.channels != 1 {
+		return a
+	}
+	ratio := float64(rate) / float64(a.rate)
+	cutoff := 1.0
+	if ratio < 1 {
+		cutoff = ratio
+	}
+	n := int(float64(len(a.samples)) * ratio)
+	out := &pcmAudio{rate: rate, channels: 1, samples: make([]float32, n), srcRate: a.srcRate}
+	half := float64(resampleTaps) / cutoff
+	for i := 0; i < n; i++ {
+		t := float64(i) / ratio // 在原始采样中的位置
+		lo := int(math.Ceil(t - half))
+		hi := int(math.Floor(t + half))
+		var sum, wsum float64
+		for j := lo; j <= hi; j++ {
+			if j < 0 || j >= len(a.samples) {
+				continue
+			}
+			x := (t - float64(j)) * cutoff
+			w := sinc(x) * blackman(x/float64(resampleTaps))
+			sum += float64(a.samples[j]) * w
+			wsum += w
+		}
+		if wsum != 0 {
+			out.samples[i] = float32(sum / wsum)
+		}
+	}
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackman is the Blackman window over [-1, 1].
+func blackman(x float64) float64 {
+	if x <= -1 || x >= 1 {
+		return 0
+	}
+	return 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2*math.Pi*x)
+}
+
+// s16le returns the samples as 16 bits little endian pcm.
+func (a *pcmAudio) s16le() []byte {
+	b := make([]byte, len(a.samples)*2)
+	for i, v := range a.samples {
+		binary.LittleEndian.PutUint16(b[i*2:], uint16(toInt16(v)))
+	}
+	return b
+}
+
+func toInt16(v float32) int16 {
+	v *= 32768
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+// fromS16le wraps 16 bits little endian mono pcm.
+func fromS16le(b []byte, rate int) *pcmAudio {
+	a := &pcmAudio{rate: rate, channels: 1, samples: make([]float32, len(b)/2)}
+	for i := range a.samples {
+		a.samples[i] = float32(int16(binary.LittleEndian.Uint16(b[i*2:]))) / 32768
+	}
+	return a
+}
+
+// encodeWav wraps 16 bits little endian mono pcm in a wav header.
+func encodeWav(pcm []byte, rate int) []byte {
+	b := make([]byte, 44, 44+len(pcm))
+	copy(b[0:], "RIFF")
+	binary.LittleEndian.PutUint32(b[4:], uint32(36+len(pcm)))
+	copy(b[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(b[16:], 16)
+	binary.LittleEndian.PutUint16(b[20:], 1) // pcm
+	binary.LittleEndian.PutUint16(b[22:], 1) // mono
+	binary.LittleEndian.PutUint32(b[24:], uint32(rate))
+	binary.LittleEndian.PutUint32(b[28:], uint32(rate*2))
+	binary.LittleEndian.PutUint16(b[32:], 2)
+	binary.LittleEndian.PutUint16(b[34:], 16)
+	copy(b[36:], "data")
+	binary.LittleEndian.PutUint32(b[40:], uint32(len(pcm)))
+	return append(b, pcm...)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// wavHeader builds a 16 bits pcm wav with the given header fields around data.
+func wavHeader(channels, rate int, data []byte) []byte {
+	b := encodeWav(data, rate)
+	binary.LittleEndian.PutUint16(b[22:], uint16(channels))
+	return b
+}
+
+func sine(freq float64, rate, n int) []byte {
+	b := make([]byte, n*2)
+	for i := 0; i < n; i++ {
+		v := int16(16000 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+		binary.LittleEndian.PutUint16(b[i*2:], uint16(v))
+	}
+	return b
+}
+
+func TestDecodeWav(t *testing.T) {
+	data := []byte{0, 0, 0, 0x40, 0, 0xc0, 0xff, 0x7f}
+	a, err := decodeWav(wavHeader(2, 44100, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.rate != 44100 || a.channels != 2 || len(a.samples) != 4 {
+		t.Fatalf("got rate %d channels %d samples %d", a.rate, a.channels, len(a.samples))
+	}
+	want := []float32{0, 0.5, -0.5, 32767.0 / 32768}
+	for i, v := range want {
+		if a.samples[i] != v {
+			t.Errorf("sample %d = %v, want %v", i, a.samples[i], v)
+		}
+	}
+	m := a.mono()
+	if m.channels != 1 || len(m.samples) != 2 || m.samples[0] != 0.25 {
+		t.Errorf("mono = %v", m.samples)
+	}
+}
+
+func TestDecodeWavInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"not riff", []byte("hello world, not a wav")},
+		{"tiny rate", wavHeader(1, 8, make([]byte, 1000))},
+		{"huge rate", wavHeader(1, 1000000, make([]byte, 1000))},
+		{"no channels", wavHeader(0, 16000, make([]byte, 1000))},
+		{"too many channels", wavHeader(64, 16000, make([]byte, 1000))},
+		{"no data", encodeWav(nil, 16000)[:36]},
+	}
+	for _, tt := range tests {
+		if _, err := decodeWav(tt.b); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestDecodeAudioMaxDuration(t *testing.T) {
+	// 200 KB at the lowest rate is 25 s, the check runs before resampling
+	b := wavHeader(1, minSampleRate, make([]byte, 200000))
+	st := time.Now()
+	_, err := decodeAudio(context.Background(), b, sniffFormat(b), AudioConfig{MaxDuration: 10})
+	if err == nil {
+		t.Fatal("no error for audio longer than max_duration")
+	}
+	if d := time.Since(st); d > time.Second {
+		t.Errorf("rejecting took %v", d)
+	}
+	a, err := decodeAudio(context.Background(), b, sniffFormat(b), AudioConfig{MaxDuration: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.rate != speechRate || a.srcRate != minSampleRate {
+		t.Errorf("rate %d srcRate %d", a.rate, a.srcRate)
+	}
+}
+
+func TestResample(t *testing.T) {
+	const n = 48000
+	a, err := decodeWav(encodeWav(sine(440, 48000, n), 48000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := a.resample(speechRate)
+	if r.rate != speechRate || len(r.samples) != n/3 {
+		t.Fatalf("rate %d samples %d", r.rate, len(r.samples))
+	}
+	// 中间部分应该还是同样的正弦波
+	for i := 1000; i < len(r.samples)-1000; i += 97 {
+		want := 16000.0 / 32768 * math.Sin(2*math.Pi*440*float64(i)/speechRate)
+		if d := math.Abs(float64(r.samples[i]) - want); d > 0.01 {
+			t.Fatalf("sample %d = %v, want %v", i, r.samples[i], want)
+		}
+	}
+	// 降采样时高于新奈奎斯特频率的部分被滤掉
+	hi, _ := decodeWav(encodeWav(sine(12000, 48000, n), 48000))
+	var sum float64
+	for _, v := range hi.resample(speechRate).samples[1000 : n/3-1000] {
+		sum += float64(v) * float64(v)
+	}
+	if rms := math.Sqrt(sum / float64(n/3-2000)); rms > 0.01 {
+		t.Errorf("12 kHz rms after resampling to 16 kHz = %v", rms)
+	}
+}
+
+// fakeFFmpeg is a script which ignores its arguments and writes seconds of 16 kHz silence.
+func fakeFFmpeg(t *testing.T, seconds int) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "ffmpeg")
+	script := fmt.Sprintf("#!/bin/sh\ncat > /dev/null\nhead -c %d /dev/zero\n", seconds*speechRate*2)
+	if err := os.WriteFile(p, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestDecodeAudioFFmpegFallback(t *testing.T) {
+	// μ-law 不能原生解码，交给 ffmpeg
+	ulaw := wavHeader(1, 8000, make([]byte, 8000))
+	binary.LittleEndian.PutUint16(ulaw[20:], 7)
+	binary.LittleEndian.PutUint16(ulaw[34:], 8)
+	if _, err := decodeAudio(context.Background(), ulaw, formatWav, AudioConfig{MaxDuration: 10}); err == nil {
+		t.Fatal("μ-law decoded without ffmpeg")
+	}
+	c := AudioConfig{FFmpeg: fakeFFmpeg(t, 1), MaxDuration: 10}
+	a, err := decodeAudio(context.Background(), ulaw, formatWav, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.rate != speechRate || len(a.samples) != speechRate || a.srcRate != 0 {
+		t.Errorf("rate %d samples %d srcRate %d", a.rate, len(a.samples), a.srcRate)
+	}
+	// 采样率被拒绝的不交给 ffmpeg
+	if _, err := decodeAudio(context.Background(), wavHeader(1, 8, make([]byte, 1000)), formatWav, c); !errors.Is(err, errInvalidFormat) {
+		t.Errorf("tiny rate: %v", err)
+	}
+	c.FFmpeg = fakeFFmpeg(t, 20)
+	if _, err := decodeAudio(context.Background(), ulaw, formatWav, c); err == nil {
+		t.Error("no error for ffmpeg output longer than max_duration")
+	}
+}
+
+func TestFindFFmpeg(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if p, err := findFFmpeg(defaultConfig().Audio); p != "" || err != nil {
+		t.Errorf("default config: %q, %v", p, err)
+	}
+	if _, err := findFFmpeg(AudioConfig{RequireFFmpeg: true}); err == nil {
+		t.Error("no error when ffmpeg is required")
+	}
+	if _, err := findFFmpeg(AudioConfig{FFmpeg: "/nonexistent/ffmpeg"}); err == nil {
+		t.Error("no error for a missing audio.ffmpeg")
+	}
+	p := fakeFFmpeg(t, 1)
+	if got, err := findFFmpeg(AudioConfig{FFmpeg: p, RequireFFmpeg: true}); got != p || err != nil {
+		t.Errorf("audio.ffmpeg: %q, %v", got, err)
+	}
+}
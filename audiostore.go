@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AudioStoreConfig selects where the recordings are archived:
+// "fs" is the -f directory of this instance, "s3" is a bucket shared by all instances.
+// Reviewers list the recordings of an address on /review with ReviewToken and download them with signed urls.
+type AudioStoreConfig struct {
+	Type        string        `yaml:"type"`
+	SignKey     string        `yaml:"sign_key"` // fs: hmac key of the signed urls
+	BaseURL     string        `yaml:"base_url"` // fs: public url of this server, prefix of the signed urls
+	S3          S3Config      `yaml:"s3"`
+	ReviewToken string        `yaml:"review_token"` // /review bearer token, empty disables /review
+	URLExpiry   time.Duration `yaml:"url_expiry"`   // signed url 有效期
+}
+
+var errNoAudio = errors.New("audio not found")
+
+// AudioStore keeps the archived recordings by key, a slash separated path like <address>/<yyyy-mm-dd>/<job id>/<name>.
+type AudioStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns errNoAudio if key does not exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+	// List returns the objects whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]audioObject, error)
+	// SignedURL returns a url which downloads key without other credentials until ttl passes.
+	SignedURL(key string, ttl time.Duration) (string, error)
+}
+
+type audioObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+func newAudioStore(c AudioStoreConfig, dir string) (AudioStore, error) {
+	switch c.Type {
+	case "", "fs":
+		return newFSAudioStore(dir, c.SignKey, c.BaseURL), nil
+	case "s3":
+		return newS3AudioStore(c.S3), nil
+	}
+	return nil, fmt.Errorf("unknown audio store type %q", c.Type)
+}
+
+// fsAudioStore is the local directory implementation, the key is the path relative to dir.
+// Its signed urls point to /audio of this server, which is served by ServeHTTP.
+type fsAudioStore struct {
+	dir     string
+	signKey []byte
+	baseURL string
+}
+
+func newFSAudioStore(dir, signKey, baseURL string) *fsAudioStore {
+	return &fsAudioStore{dir: dir, signKey: []byte(signKey), baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// path returns the file of key, keys escaping dir are rejected.
+func (f *fsAudioStore) path(key string) (string, error) {
+	for _, e := range strings.Split(key, "/") {
+		if e == "" || e == "." || e == ".." {
+			return "", fmt.Errorf("invalid audio key %q", key)
+		}
+	}
+	return filepath.Join(f.dir, filepath.FromSlash(key)), nil
+}
+
+func (f *fsAudioStore) Put(ctx context.Context, key string, data []byte) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0644)
+}
+
+func (f *fsAudioStore) Get(ctx context.Context, key string) ([]byte, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNoAudio
+	}
+	return b, err
+}
+
+// Delete removes key and the directories it leaves empty, dir itself is kept.
+func (f *fsAudioStore) Delete(ctx context.Context, key string) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	root := filepath.Clean(f.dir)
+	for d := filepath.Dir(p); d != root && strings.HasPrefix(d, root); d = filepath.Dir(d) {
+		if os.Remove(d) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fsAudioStore) List(ctx context.Context, prefix string) ([]audioObject, error) {
+	var objs []audioObject
+	err := filepath.WalkDir(f.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == f.dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(f.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objs = append(objs, audioObject{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	return objs, err
+}
+
+func (f *fsAudioStore) sign(key, expires string) string {
+	h := hmac.New(sha256.New, f.signKey)
+	h.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (f *fsAudioStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	if len(f.signKey) == 0 {
+		return "", errors.New("audio_store.sign_key is not set")
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	q := url.Values{}
+	q.Set("key", key)
+	q.Set("expires", expires)
+	q.Set("sig", f.sign(key, expires))
+	return f.baseURL + "/audio?" + q.Encode(), nil
+}
+
+// ServeHTTP serves the signed urls made by SignedURL.
+func (f *fsAudioStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	key, expires, sig := q.Get("key"), q.Get("expires"), q.Get("sig")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if len(f.signKey) == 0 || err != nil || !hmac.Equal([]byte(sig), []byte(f.sign(key, expires))) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > exp {
+		http.Error(w, "url expired", http.StatusForbidden)
+		return
+	}
+	b, err := f.Get(r.Context(), key)
+	if err == errNoAudio {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := key[strings.LastIndex(key, "/")+1:]
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(name))
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(b))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// ChallengeConfig controls the phrases issued by /challenge.
+// The client reads the phrase aloud and uploads with nonce=<nonce>, the transcript must contain the phrase.
+// A nonce is bound to the address, expires after TTL and can be used once.
+// The challenges are kept in memory, so /challenge and /upload must reach the same instance.
+type ChallengeConfig struct {
+	Require bool          `yaml:"require"` // /upload 必须带 nonce，不再接受客户端的 text
+	TTL     time.Duration `yaml:"ttl"`
+	Digits  int           `yaml:"digits"`  // 数字串长度
+	Phrases []string      `yaml:"phrases"` // 非空时从中随机选择，否则发数字串
+}
+
+// maxChallenges bounds the outstanding challenges of all addresses, maxAddressChallenges those of one,
+// so a single client can not use up the others' challenges.
+const (
+	maxChallenges        = 100000
+	maxAddressChallenges = 10
+)
+
+var (
+	errChallengeNotFound = errors.New("challenge not found or already used")
+	errChallengeExpired  = errors.New("challenge expired")
+	errChallengeAddress  = errors.New("challenge was issued to another address")
+	errTooManyChallenges = errors.New("too many challenges")
+	errAddressChallenges = errors.New("too many outstanding challenges for the address")
+	errMissingNonce      = errors.New("missing nonce parameter, get one from /challenge")
+)
+
+type challenge struct {
+	Nonce   string
+	Text    string
+	Expires int // seconds from 1970-1-1
+	address string
+}
+
+type challengeStore struct {
+	c         ChallengeConfig
+	mu        sync.Mutex
+	m         map[string]*challenge
+	addresses map[string][]*challenge // 每个地址未使用的挑战
+}
+
+func newChallengeStore(c ChallengeConfig) *challengeStore {
+	return &challengeStore{c: c, m: make(map[string]*challenge), addresses: make(map[string][]*challenge)}
+}
+
+// randInt returns a uniform random number in [0, n).
+func randInt(n int) (int, error) {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(v.Int64()), nil
+}
+
+func (cs *challengeStore) text() (string, error) {
+	if len(cs.c.Phrases) > 0 {
+		i, err := randInt(len(cs.c.Phrases))
+		if err != nil {
+			return "", err
+		}
+		return cs.c.Phrases[i], nil
+	}
+	b := make([]byte, cs.c.Digits)
+	for i := range b {
+		d, err := randInt(10)
+		if err != nil {
+			return "", err
+		}
+		b[i] = byte('0' + d)
+	}
+	return string(b), nil
+}
+
+// remove deletes the challenge nonce, cs.mu must be held.
+func (cs *challengeStore) remove(nonce string) (*challenge, bool) {
+	ch, ok := cs.m[nonce]
+	if !ok {
+		return nil, false
+	}
+	delete(cs.m, nonce)
+	a := slices.DeleteFunc(cs.addresses[ch.address], func(c *challenge) bool { return c == ch })
+	if len(a) == 0 {
+		delete(cs.addresses, ch.address)
+	} else {
+		cs.addresses[ch.address] = a
+	}
+	return ch, true
+}
+
+// prune deletes the expired challenges of address, or of all addresses if it is empty. cs.mu must be held.
+func (cs *challengeStore) prune(address string, now time.Time) {
+	var expired []string
+	if address != "" {
+		for _, v := range cs.addresses[address] {
+			if int64(v.Expires) < now.Unix() {
+				expired = append(expired, v.Nonce)
+			}
+		}
+	} else {
+		for k, v := range cs.m {
+			if int64(v.Expires) < now.Unix() {
+				expired = append(expired, k)
+			}
+		}
+	}
+	for _, k := range expired {
+		cs.remove(k)
+	}
+}
+
+// issue creates a challenge for address.
+func (cs *challengeStore) issue(address string, now time.Time) (*challenge, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	text, err := cs.text()
+	if err != nil {
+		return nil, err
+	}
+	ch := &challenge{
+		Nonce:   hex.EncodeToString(nonce),
+		Text:    text,
+		Expires: int(now.Add(cs.c.TTL).Unix()),
+		address: address,
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.addresses[address]) >= maxAddressChallenges {
+		cs.prune(address, now)
+		if len(cs.addresses[address]) >= maxAddressChallenges {
+			return nil, errAddressChallenges
+		}
+	}
+	if len(cs.m) >= maxChallenges {
+		cs.prune("", now)
+		if len(cs.m) >= maxChallenges {
+			return nil, errTooManyChallenges
+		}
+	}
+	cs.m[ch.Nonce] = ch
+	cs.addresses[address] = append(cs.addresses[address], ch)
+	return ch, nil
+}
+
+// take removes the challenge nonce and returns it if it is valid for address.
+func (cs *challengeStore) take(nonce, address string, now time.Time) (*challenge, error) {
+	cs.mu.Lock()
+	ch, ok := cs.remove(nonce)
+	cs.mu.Unlock()
+	switch {
+	case !ok:
+		return nil, errChallengeNotFound
+	case int64(ch.Expires) < now.Unix():
+		return nil, errChallengeExpired
+	case ch.address != address:
+		return nil, errChallengeAddress
+	}
+	return ch, nil
+}
+
+// restore gives back a challenge taken for an upload which was not processed, so the client can retry with the nonce.
+// It is dropped if it expired or the store is full again.
+func (cs *challengeStore) restore(ch *challenge, now time.Time) {
+	if int64(ch.Expires) < now.Unix() {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.addresses[ch.address]) >= maxAddressChallenges || len(cs.m) >= maxChallenges {
+		return
+	}
+	if _, ok := cs.m[ch.Nonce]; ok {
+		return
+	}
+	cs.m[ch.Nonce] = ch
+	cs.addresses[ch.address] = append(cs.addresses[ch.address], ch)
+}
+
+// chineseDigits are the digits iat may write in hanzi.
+var chineseDigits = map[rune]rune{
+	'零': '0', '〇': '0', '一': '1', '幺': '1', '二': '2', '两': '2', '三': '3', '四': '4',
+	'五': '5', '六': '6', '七': '7', '八': '8', '九': '9',
+}
+
+// normalizeTranscript drops spaces and punctuation, lower cases letters and writes hanzi digits as 0-9,
+// so a phrase matches the transcript however iat punctuates and formats it.
+func normalizeTranscript(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if d, ok := chineseDigits[r]; ok {
+			r = d
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+func (s *server) challengeHandler(w http.ResponseWriter, r *http.Request) {
+	// 设置CORS头
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		http.Error(w, "Missing address parameter", http.StatusBadRequest)
+		log.Println("Missing address parameter")
+		return
+	}
+	ch, err := s.challenges.issue(address, time.Now())
+	if err != nil {
+		log.Println("issue challenge error:", err, "address:", address)
+		code := http.StatusServiceUnavailable
+		if err == errAddressChallenges {
+			code = http.StatusTooManyRequests
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(ch)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestChallengeStore(t *testing.T) {
+	cs := newChallengeStore(ChallengeConfig{TTL: time.Minute, Digits: 6})
+	now := time.Now()
+	ch, err := cs.issue("a", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.Text) != 6 || normalizeTranscript(ch.Text) != ch.Text {
+		t.Errorf("text %q is not 6 digits", ch.Text)
+	}
+	if _, err := cs.take(ch.Nonce, "b", now); err != errChallengeAddress {
+		t.Errorf("take by another address: %v", err)
+	}
+	// 用错地址也会消耗掉 nonce
+	if _, err := cs.take(ch.Nonce, "a", now); err != errChallengeNotFound {
+		t.Errorf("take twice: %v", err)
+	}
+	ch, _ = cs.issue("a", now)
+	if _, err := cs.take(ch.Nonce, "a", now.Add(2*time.Minute)); err != errChallengeExpired {
+		t.Errorf("take expired: %v", err)
+	}
+
+	// 一个地址最多 maxAddressChallenges 个，其他地址不受影响，过期的不计
+	for i := 0; i < maxAddressChallenges; i++ {
+		if _, err := cs.issue("a", now); err != nil {
+			t.Fatalf("challenge %d: %v", i, err)
+		}
+	}
+	if _, err := cs.issue("a", now); err != errAddressChallenges {
+		t.Errorf("challenge over the address cap: %v", err)
+	}
+	if _, err := cs.issue("b", now); err != nil {
+		t.Errorf("challenge of another address: %v", err)
+	}
+	if _, err := cs.issue("a", now.Add(2*time.Minute)); err != nil {
+		t.Errorf("challenge after the others expired: %v", err)
+	}
+	if len(cs.m) != 2 || len(cs.addresses["a"]) != 1 || len(cs.addresses["b"]) != 1 {
+		t.Errorf("%d challenges left, %d of a and %d of b", len(cs.m), len(cs.addresses["a"]), len(cs.addresses["b"]))
+	}
+}
+
+func TestChallengeRestore(t *testing.T) {
+	cs := newChallengeStore(ChallengeConfig{TTL: time.Minute, Digits: 6})
+	now := time.Now()
+	ch, _ := cs.issue("a", now)
+	taken, _ := cs.take(ch.Nonce, "a", now)
+	cs.restore(taken, now)
+	if again, err := cs.take(ch.Nonce, "a", now); err != nil || again.Text != ch.Text {
+		t.Fatalf("take after restore: %v", err)
+	}
+	// 过期的不还回去
+	cs.restore(taken, now.Add(2*time.Minute))
+	if len(cs.m) != 0 || len(cs.addresses) != 0 {
+		t.Errorf("expired challenge restored")
+	}
+
+	// 因为限流没有调用接口的上传
+	s := newServer(defaultConfig(), 0.36, serverDeps{store: newMemStore(10), audio: newFSAudioStore(t.TempDir(), "", "")})
+	ch, _ = s.challenges.issue("a", now)
+	taken, _ = s.challenges.take(ch.Nonce, "a", now)
+	j := &uploadJob{jobId: "j1", address: "a", challenge: taken, result: &UploadResult{Result: 2, RetryAfter: 1}}
+	s.finish(context.Background(), j)
+	if _, err := s.challenges.take(ch.Nonce, "a", now); err != nil {
+		t.Errorf("take after a rate limited upload: %v", err)
+	}
+}
+
+func TestUploadRestoresNonce(t *testing.T) {
+	ts := newTestServer(t, testScript, func(c *Config) { c.Audio.MaxBytes = 1000 })
+	resp, err := http.Get(ts.URL + "/challenge?address=0xabc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ch challenge
+	json.NewDecoder(resp.Body).Decode(&ch)
+	resp.Body.Close()
+	post := func(size int) int {
+		q := url.Values{"address": {"0xabc"}, "nonce": {ch.Nonce}}
+		resp, err := http.Post(ts.URL+"/upload?"+q.Encode(), "audio/wav", bytes.NewReader(encodeWav(make([]byte, size), speechRate)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// 请求体太大时没有处理，nonce 还能用
+	if code := post(2000); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("large upload: %d", code)
+	}
+	if code := post(800); code == http.StatusBadRequest && getResult(t, ts, "0xabc", "").Reason == reasonChallenge {
+		t.Fatal("nonce is used by the rejected upload")
+	}
+	// 处理过的上传用掉 nonce
+	if code := post(800); code != http.StatusBadRequest || getResult(t, ts, "0xabc", "").Reason != reasonChallenge {
+		t.Errorf("nonce used twice: %d", code)
+	}
+}
+
+func TestNormalizeTranscript(t *testing.T) {
+	for in, want := range map[string]string{
+		"三七二，九零 5。":    "372905",
+		"Open Sesame!": "opensesame",
+		"芝麻，开门。":       "芝麻开门",
+	} {
+		if got := normalizeTranscript(in); got != want {
+			t.Errorf("normalizeTranscript(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
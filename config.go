@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the runtime configuration of vps.
+// It is loaded from a yaml file (-c flag), then overridden by VPS_* environment variables.
+type Config struct {
+	Xfyun     XfyunConfig     `yaml:"xfyun"`
+	Iat       IatConfig       `yaml:"iat"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Store     StoreConfig     `yaml:"store"`
+	Jobs      JobsConfig      `yaml:"jobs"`
+	Audio     AudioConfig     `yaml:"audio"`
+	VAD       VADConfig       `yaml:"vad"`
+	Quality   QualityConfig   `yaml:"quality"`
+	MP3       MP3Config       `yaml:"mp3"`
+	Archive   ArchiveConfig   `yaml:"archive"`
+	Replay    ReplayConfig    `yaml:"replay"`
+	Challenge ChallengeConfig `yaml:"challenge"`
+	Enroll    EnrollConfig    `yaml:"enroll"`
+
+	// Limits bounds the calls to each xfyun api by name: iat, searchScoreFea, searchFea, createFeature,
+	// deleteFeature. The apis without an entry use the "default" one, if any.
+	Limits map[string]LimitConfig `yaml:"limits"`
+
+	AudioStore AudioStoreConfig `yaml:"audio_store"`
+}
+
+// XfyunConfig holds the credentials and endpoints of the xfyun open platform.
+type XfyunConfig struct {
+	AppId     string `yaml:"app_id"`
+	ApiKey    string `yaml:"api_key"`
+	ApiSecret string `yaml:"api_secret"`
+	IatUrl    string `yaml:"iat_url"` // 语音听写 websocket 地址
+	VrgUrl    string `yaml:"vrg_url"` // 声纹识别 s782b4996 地址
+	// VrgEncoding is the audio sent to s782b4996: "lame" (mp3) or "raw" (16 kHz mono pcm, no mp3 encoding)
+	VrgEncoding string      `yaml:"vrg_encoding"`
+	Retry       RetryConfig `yaml:"retry"`
+	HTTP        HTTPConfig  `yaml:"http"` // 声纹接口的 http 客户端
+}
+
+// TLSConfig controls the https server.
+// If ClientCAFile is set, /upload only accepts clients presenting a certificate signed by that CA.
+type TLSConfig struct {
+	Enable         bool          `yaml:"enable"`
+	Addr           string        `yaml:"addr"`
+	CertFile       string        `yaml:"cert_file"`
+	KeyFile        string        `yaml:"key_file"`
+	ClientCAFile   string        `yaml:"client_ca_file"`
+	ReloadInterval time.Duration `yaml:"reload_interval"` // 证书文件检查间隔
+}
+
+// StoreConfig selects the result store: "memory" or "bolt" (a bbolt file at Path).
+// Each address keeps at most History (at least 1) results, results older than TTL are evicted.
+type StoreConfig struct {
+	Type          string        `yaml:"type"`
+	Path          string        `yaml:"path"`
+	History       int           `yaml:"history"`
+	TTL           time.Duration `yaml:"ttl"`
+	EvictInterval time.Duration `yaml:"evict_interval"`
+}
+
+// JobsConfig controls async uploads.
+// If Async is true, /upload returns a job id at once and Workers goroutines process the queued jobs;
+// the async query parameter overrides it per request.
+type JobsConfig struct {
+	Async   bool          `yaml:"async"`
+	Workers int           `yaml:"workers"`
+	Queue   int           `yaml:"queue"`
+	Timeout time.Duration `yaml:"timeout"` // 一次上传的处理时间上限，包括所有 xfyun 调用和重试
+}
+
+// AudioConfig controls audio decoding.
+// Wav and ogg vorbis are decoded natively; webm/opus, ogg/opus, mp3 and m4a need ffmpeg, see findFFmpeg.
+// Uploads larger than MaxBytes or longer than MaxDuration seconds are rejected before resampling.
+type AudioConfig struct {
+	FFmpeg        string  `yaml:"ffmpeg"`         // 为空时在 PATH 中查找
+	RequireFFmpeg bool    `yaml:"require_ffmpeg"` // 找不到 ffmpeg 时拒绝启动
+	MaxBytes      int64   `yaml:"max_bytes"`
+	MaxDuration   float64 `yaml:"max_duration"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Xfyun: XfyunConfig{
+			IatUrl:      "wss://iat-api.xfyun.cn/v2/iat",
+			VrgUrl:      "https://api.xf-yun.com/v1/private/s782b4996",
+			VrgEncoding: encodingLame,
+			Retry:       RetryConfig{Attempts: 3, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second},
+			HTTP: HTTPConfig{
+				ConnectTimeout:  5 * time.Second,
+				Timeout:         30 * time.Second,
+				MaxIdleConns:    10,
+				IdleConnTimeout: 90 * time.Second,
+			},
+		},
+		Iat: IatConfig{
+			Chinese: IatOptions{Domain: "iat", VadEos: 2000, Ptt: true, Dwa: true, Nunum: true},
+			Other:   IatOptions{Domain: "iat", VadEos: 2000, Ptt: true},
+		},
+		Audio: AudioConfig{
+			MaxBytes:    10 << 20,
+			MaxDuration: 60,
+		},
+		TLS: TLSConfig{
+			Addr:           ":443",
+			CertFile:       "server.crt",
+			KeyFile:        "server.key",
+			ReloadInterval: 10 * time.Second,
+		},
+		Store: StoreConfig{
+			Type:          "bolt",
+			Path:          "./vps.db",
+			History:       10,
+			TTL:           7 * 24 * time.Hour,
+			EvictInterval: 10 * time.Minute,
+		},
+		Jobs: JobsConfig{
+			Workers: 4,
+			Queue:   100,
+			Timeout: time.Minute,
+		},
+		VAD: VADConfig{
+			Enable:    true,
+			FrameMs:   20,
+			Threshold: 12,
+			MinEnergy: -50,
+			PaddingMs: 200,
+		},
+		Quality: QualityConfig{
+			Enable:        true,
+			MinDuration:   1,
+			MaxDuration:   30,
+			MinRms:        -40,
+			MaxClipping:   0.01,
+			MinSnr:        10,
+			MinSampleRate: 16000,
+		},
+		MP3: MP3Config{
+			Bitrate: 32,
+			Quality: 2,
+		},
+		Archive: ArchiveConfig{
+			CompressAfter: 24 * time.Hour,
+			MaxAge:        90 * 24 * time.Hour,
+			MaxSizeMB:     10240,
+			Interval:      time.Hour,
+		},
+		Replay: ReplayConfig{
+			Enable:    true,
+			Action:    replayFlag,
+			Window:    30 * 24 * time.Hour,
+			Threshold: 0.25,
+			Refresh:   time.Minute,
+		},
+		Challenge: ChallengeConfig{
+			Require: true,
+			TTL:     2 * time.Minute,
+			Digits:  6,
+		},
+		Enroll: EnrollConfig{
+			Samples:     3,
+			TTL:         10 * time.Minute,
+			MaxSessions: 1000,
+		},
+		AudioStore: AudioStoreConfig{
+			Type:      "fs",
+			URLExpiry: 15 * time.Minute,
+		},
+		Limits: map[string]LimitConfig{
+			limitDefault: {Rate: 5, Burst: 5, MaxInFlight: 10, MaxWait: 2 * time.Second},
+			"iat":        {MaxInFlight: 50, MaxWait: 2 * time.Second},
+		},
+	}
+}
+
+// loadConfig reads the config file fp (may be empty) and applies the environment overrides.
+// The caller applies flag overrides and then calls validate.
+func loadConfig(fp string) (*Config, error) {
+	c := defaultConfig()
+	if fp != "" {
+		b, err := os.ReadFile(fp)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.Unmarshal(b, c)
+		if err != nil {
+			return nil, fmt.Errorf("parse config %s: %w", fp, err)
+		}
+	}
+	c.applyEnv()
+	return c, nil
+}
+
+func (c *Config) applyEnv() {
+	envs := map[string]*string{
+		"VPS_XFYUN_APP_ID":         &c.Xfyun.AppId,
+		"VPS_XFYUN_API_KEY":        &c.Xfyun.ApiKey,
+		"VPS_XFYUN_API_SECRET":     &c.Xfyun.ApiSecret,
+		"VPS_XFYUN_IAT_URL":        &c.Xfyun.IatUrl,
+		"VPS_XFYUN_VRG_URL":        &c.Xfyun.VrgUrl,
+		"VPS_XFYUN_VRG_ENCODING":   &c.Xfyun.VrgEncoding,
+		"VPS_TLS_CERT_FILE":        &c.TLS.CertFile,
+		"VPS_TLS_KEY_FILE":         &c.TLS.KeyFile,
+		"VPS_STORE_TYPE":           &c.Store.Type,
+		"VPS_STORE_PATH":           &c.Store.Path,
+		"VPS_AUDIO_STORE_TYPE":     &c.AudioStore.Type,
+		"VPS_AUDIO_STORE_SIGN_KEY": &c.AudioStore.SignKey,
+		"VPS_REVIEW_TOKEN":         &c.AudioStore.ReviewToken,
+		"VPS_S3_ACCESS_KEY":        &c.AudioStore.S3.AccessKey,
+		"VPS_S3_SECRET_KEY":        &c.AudioStore.S3.SecretKey,
+	}
+	for k, p := range envs {
+		if v, ok := os.LookupEnv(k); ok {
+			*p = v
+		}
+	}
+}
+
+func (c *Config) validate() error {
+	type field struct {
+		name  string
+		value string
+	}
+	required := []field{
+		{"xfyun.app_id", c.Xfyun.AppId},
+		{"xfyun.api_key", c.Xfyun.ApiKey},
+		{"xfyun.api_secret", c.Xfyun.ApiSecret},
+		{"xfyun.iat_url", c.Xfyun.IatUrl},
+		{"xfyun.vrg_url", c.Xfyun.VrgUrl},
+	}
+	if c.TLS.Enable {
+		required = append(required,
+			field{"tls.addr", c.TLS.Addr},
+			field{"tls.cert_file", c.TLS.CertFile},
+			field{"tls.key_file", c.TLS.KeyFile},
+		)
+	}
+	if c.Store.Type == "bolt" {
+		required = append(required, field{"store.path", c.Store.Path})
+	}
+	if c.AudioStore.Type == "s3" {
+		required = append(required,
+			field{"audio_store.s3.endpoint", c.AudioStore.S3.Endpoint},
+			field{"audio_store.s3.bucket", c.AudioStore.S3.Bucket},
+			field{"audio_store.s3.access_key", c.AudioStore.S3.AccessKey},
+			field{"audio_store.s3.secret_key", c.AudioStore.S3.SecretKey},
+		)
+	} else if c.AudioStore.ReviewToken != "" {
+		required = append(required, field{"audio_store.sign_key", c.AudioStore.SignKey})
+	}
+	if c.Store.History <= 0 {
+		return errors.New("store.history must be positive")
+	}
+	if c.Jobs.Workers <= 0 {
+		return errors.New("jobs.workers must be positive")
+	}
+	if c.Jobs.Timeout <= 0 {
+		return errors.New("jobs.timeout must be positive")
+	}
+	if c.Xfyun.VrgEncoding != encodingLame && c.Xfyun.VrgEncoding != encodingRaw {
+		return errors.New("xfyun.vrg_encoding must be lame or raw")
+	}
+	err := c.Iat.validate()
+	if err != nil {
+		return err
+	}
+	if c.Xfyun.HTTP.ConnectTimeout < 0 || c.Xfyun.HTTP.Timeout < 0 || c.Xfyun.HTTP.IdleConnTimeout < 0 {
+		return errors.New("xfyun.http timeouts must not be negative")
+	}
+	if c.Xfyun.Retry.Attempts < 1 {
+		return errors.New("xfyun.retry.attempts must be at least 1")
+	}
+	if c.Audio.MaxBytes <= 0 || c.Audio.MaxDuration <= 0 {
+		return errors.New("audio.max_bytes and audio.max_duration must be positive")
+	}
+	if c.MP3.Quality < 0 || c.MP3.Quality > 9 {
+		return errors.New("mp3.quality must be in 0-9")
+	}
+	if c.Replay.Enable && c.Replay.Action != replayReject && c.Replay.Action != replayFlag {
+		return errors.New("replay.action must be reject or flag")
+	}
+	if len(c.Challenge.Phrases) == 0 && c.Challenge.Digits <= 0 {
+		return errors.New("challenge.digits must be positive without challenge.phrases")
+	}
+	if c.Challenge.TTL <= 0 {
+		return errors.New("challenge.ttl must be positive")
+	}
+	if c.Enroll.Samples < 1 {
+		return errors.New("enroll.samples must be at least 1")
+	}
+	if c.Enroll.MaxSessions <= 0 {
+		return errors.New("enroll.max_sessions must be positive")
+	}
+	for k, l := range c.Limits {
+		if l.Rate < 0 || l.Burst < 0 || l.MaxInFlight < 0 || l.MaxWait < 0 {
+			return fmt.Errorf("limits.%s must not be negative", k)
+		}
+	}
+	if c.VAD.Enable && c.VAD.FrameMs <= 0 {
+		return errors.New("vad.frame_ms must be positive")
+	}
+	var missing []string
+	for _, r := range required {
+		if r.value == "" {
+			missing = append(missing, r.name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("missing required config: " + strings.Join(missing, ", "))
+	}
+	return nil
+}
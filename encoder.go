@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+
+	"github.com/youthlin/go-lame"
+)
+
+// MP3Config controls the mp3 sent to the voiceprint api.
+type MP3Config struct {
+	Bitrate int `yaml:"bitrate"` // kbps, 0 is the lame default
+	Quality int `yaml:"quality"` // lame algorithm quality, 0 is best and slowest, 9 is worst and fastest
+}
+
+// mp3Chunk is the number of samples encoded at a time.
+const mp3Chunk = 4096
+
+// encodeMp3 encodes audio a to w as the s782b4996 payload declares it: 16 kHz, mono, 16 bits.
+// Only a chunk of the samples is converted to int16 at a time, and lame is flushed at the end.
+// The mp3 itself is not smaller in memory: the api takes it base64 encoded in one request body.
+func encodeMp3(w io.Writer, a *pcmAudio, c MP3Config) error {
+	a = a.mono().resample(speechRate)
+
+	l, err := lame.NewLame()
+	if err != nil {
+		return err
+	}
+	err = setupLame(l, c)
+	if err != nil {
+		return err
+	}
+
+	pcm := make([]int16, mp3Chunk)
+	// lame 建议的输出缓冲大小: 1.25 * 采样数 + 7200
+	buf := make([]byte, mp3Chunk*5/4+7200)
+	for p := 0; p < len(a.samples); p += mp3Chunk {
+		end := min(p+mp3Chunk, len(a.samples))
+		in := pcm[:end-p]
+		for i, v := range a.samples[p:end] {
+			in[i] = toInt16(v)
+		}
+		n, err := l.EncodeInt16(in, in, buf)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+	}
+	residual, err := l.EncodeFlush()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(residual)
+	return err
+}
+
+func setupLame(l *lame.Lame, c MP3Config) error {
+	err := l.SetInSampleRate(speechRate)
+	if err != nil {
+		return err
+	}
+	err = l.SetOutSampleRate(speechRate)
+	if err != nil {
+		return err
+	}
+	err = l.SetNumChannels(1)
+	if err != nil {
+		return err
+	}
+	err = l.SetMode(lame.MODE_MONO)
+	if err != nil {
+		return err
+	}
+	err = l.SetQuality(c.Quality)
+	if err != nil {
+		return err
+	}
+	if c.Bitrate > 0 {
+		err = l.SetBrate(c.Bitrate)
+		if err != nil {
+			return err
+		}
+	}
+	return l.InitParams()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// mp3Frame is the header of an mpeg 2 layer III frame, the format lame writes for 16 kHz.
+type mp3Frame struct {
+	bitrate int // kbps
+	rate    int
+	mono    bool
+	size    int
+}
+
+var mpeg2Bitrates = []int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+
+func parseMp3Frames(t *testing.T, b []byte) []mp3Frame {
+	t.Helper()
+	var frames []mp3Frame
+	for len(b) > 0 {
+		// 同步字、MPEG 2、Layer III
+		if len(b) < 4 || b[0] != 0xff || b[1]&0xfe != 0xf2 {
+			t.Fatalf("no frame header at %d bytes from the end: % x", len(b), b[:min(4, len(b))])
+		}
+		f := mp3Frame{
+			bitrate: mpeg2Bitrates[b[2]>>4],
+			rate:    []int{22050, 24000, 16000, 0}[b[2]>>2&3],
+			mono:    b[3]>>6 == 3,
+		}
+		f.size = 72000*f.bitrate/f.rate + int(b[2]>>1&1)
+		if f.bitrate == 0 || f.rate == 0 || f.size > len(b) {
+			t.Fatalf("bad frame %+v with %d bytes left", f, len(b))
+		}
+		frames = append(frames, f)
+		b = b[f.size:]
+	}
+	return frames
+}
+
+func TestEncodeMp3(t *testing.T) {
+	a := testUtterance(0.5, 2, 0.3)
+	for _, c := range []MP3Config{{Bitrate: 32, Quality: 2}, {Bitrate: 64, Quality: 9}} {
+		var buf bytes.Buffer
+		if err := encodeMp3(&buf, a, c); err != nil {
+			t.Fatal(err)
+		}
+		frames := parseMp3Frames(t, buf.Bytes())
+		for i, f := range frames {
+			if f.bitrate != c.Bitrate || f.rate != speechRate || !f.mono {
+				t.Fatalf("%+v: frame %d is %+v", c, i, f)
+			}
+		}
+		// 每帧 576 个采样，flush 之后所有采样都编码了
+		if n := len(frames) * 576; n < len(a.samples) {
+			t.Errorf("%+v: %d frames hold %d samples, want %d", c, len(frames), n, len(a.samples))
+		}
+	}
+
+	// 双声道和其他采样率先转换
+	stereo := &pcmAudio{rate: 44100, channels: 2, samples: make([]float32, 2*44100)}
+	var buf bytes.Buffer
+	if err := encodeMp3(&buf, stereo, MP3Config{Bitrate: 32}); err != nil {
+		t.Fatal(err)
+	}
+	if frames := parseMp3Frames(t, buf.Bytes()); len(frames)*576 < speechRate || frames[0].rate != speechRate || !frames[0].mono {
+		t.Errorf("stereo 44.1 kHz: %d frames %+v", len(frames), frames[0])
+	}
+}
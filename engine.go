@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// errNoFeature is returned by VoiceprintEngine when the feature (1:1) or the group (1:N) has nothing to compare with.
+var errNoFeature = errors.New("feature not found")
+
+// SpeechRecognizer turns speech into text.
+type SpeechRecognizer interface {
+	// Recognize returns the transcript of pcm, which is 16 kHz mono s16le audio.
+	Recognize(ctx context.Context, pcm []byte, opts IatOptions) (*Transcript, error)
+}
+
+// StreamRecognizer is a SpeechRecognizer which also takes audio as it is recorded.
+type StreamRecognizer interface {
+	// RecognizeStream starts a session, opts is as in Recognize.
+	RecognizeStream(ctx context.Context, opts IatOptions) (RecognizeStream, error)
+}
+
+// RecognizeStream is one streaming recognition session.
+// Send and CloseSend may be called from another goroutine than Recv.
+type RecognizeStream interface {
+	// Send sends more 16 kHz mono s16le audio.
+	Send(pcm []byte) error
+	// CloseSend marks the end of the audio.
+	CloseSend() error
+	// Recv waits for the next result and returns the transcript so far, final is true once all audio is recognized.
+	Recv() (transcript *Transcript, final bool, err error)
+	Close() error
+}
+
+// VoiceprintEngine manages the voiceprint features of one group.
+// audio is the recording sent to the vendor, mp3 or 16 kHz mono s16le pcm depending on the engine config.
+type VoiceprintEngine interface {
+	// Verify scores audio against featureId (1:1).
+	Verify(ctx context.Context, featureId string, audio []byte) (*VoiceprintResult, error)
+	// Identify returns the best matching feature of the group (1:N).
+	Identify(ctx context.Context, audio []byte) (*VoiceprintResult, error)
+	// Enroll creates featureId from audio.
+	Enroll(ctx context.Context, featureId, featureInfo string, audio []byte) error
+	// Delete removes featureId from the group.
+	Delete(ctx context.Context, featureId string) error
+}
+
+// VoiceprintResult is the feature found by VoiceprintEngine.Identify or scored by Verify.
+type VoiceprintResult struct {
+	FeatureId string
+	Score     float64
+}
+
+// xfRecognizer is the xfyun iat websocket api, the sessions are bounded by the "iat" limits.
+type xfRecognizer struct {
+	c      XfyunConfig
+	limits *limits
+}
+
+func newXfRecognizer(c XfyunConfig, limits *limits) *xfRecognizer {
+	return &xfRecognizer{c: c, limits: limits}
+}
+
+// Recognize makes the session again if it fails with a transient error, see XfyunConfig.Retry.
+func (x *xfRecognizer) Recognize(ctx context.Context, pcm []byte, opts IatOptions) (*Transcript, error) {
+	var t *Transcript
+	err := retry(ctx, x.c.Retry, "iat", transient, func() error {
+		release, err := x.limits.acquire(ctx, "iat")
+		if err != nil {
+			return err
+		}
+		defer release()
+		t, err = iat(ctx, x.c, pcm, opts)
+		return err
+	})
+	return t, err
+}
+
+func (x *xfRecognizer) RecognizeStream(ctx context.Context, opts IatOptions) (RecognizeStream, error) {
+	release, err := x.limits.acquire(ctx, "iat")
+	if err != nil {
+		return nil, err
+	}
+	st, err := dialIat(ctx, x.c, opts)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &limitedStream{RecognizeStream: st, release: release}, nil
+}
+
+// xfVoiceprint is the xfyun s782b4996 voiceprint api, each function is bounded by the limits of its apiName.
+type xfVoiceprint struct {
+	c       XfyunConfig
+	groupId string
+	limits  *limits
+	client  *http.Client
+}
+
+func newXfVoiceprint(c XfyunConfig, groupId string, limits *limits, client *http.Client) *xfVoiceprint {
+	return &xfVoiceprint{c: c, groupId: groupId, limits: limits, client: client}
+}
+
+// call makes the request again if it fails with a transient error, see XfyunConfig.Retry.
+// A request which is not idempotent is only made again if the failed one surely had no effect.
+func (x *xfVoiceprint) call(ctx context.Context, r *reqInfo, idempotent bool) (*VoiceprintResult, error) {
+	r.url = x.c.VrgUrl
+	r.appId = x.c.AppId
+	r.apiSecret = x.c.ApiSecret
+	r.apiKey = x.c.ApiKey
+	r.topK = 1
+	r.groupId = x.groupId
+	r.groupInfo = x.groupId
+	r.groupName = x.groupId
+	r.encoding = x.c.VrgEncoding
+	log.Println(r.apiName, r.featureId, r.featureInfo)
+
+	retryable := transient
+	if !idempotent {
+		// 创建和删除超时后可能已经生效，再调用会报特征已存在或不存在
+		retryable = unsent
+	}
+	var res *VoiceprintResult
+	err := retry(ctx, x.c.Retry, r.apiName, retryable, func() error {
+		release, err := x.limits.acquire(ctx, r.apiName)
+		if err != nil {
+			return err
+		}
+		defer release()
+		res, err = reqURL(ctx, x.client, r)
+		return err
+	})
+	return res, err
+}
+
+func (x *xfVoiceprint) Verify(ctx context.Context, featureId string, audio []byte) (*VoiceprintResult, error) {
+	res, err := x.call(ctx, &reqInfo{
+		apiName:   "searchScoreFea",
+		featureId: featureId,
+		audio:     base64.StdEncoding.EncodeToString(audio),
+	}, true)
+	if errors.Is(err, errNoFeature) {
+		return nil, errNoFeature
+	}
+	return res, err
+}
+
+func (x *xfVoiceprint) Identify(ctx context.Context, audio []byte) (*VoiceprintResult, error) {
+	res, err := x.call(ctx, &reqInfo{
+		apiName: "searchFea",
+		audio:   base64.StdEncoding.EncodeToString(audio),
+	}, true)
+	if errors.Is(err, errNoFeature) {
+		return nil, errNoFeature
+	}
+	return res, err
+}
+
+func (x *xfVoiceprint) Enroll(ctx context.Context, featureId, featureInfo string, audio []byte) error {
+	_, err := x.call(ctx, &reqInfo{
+		apiName:     "createFeature",
+		featureId:   featureId,
+		featureInfo: featureInfo,
+		audio:       base64.StdEncoding.EncodeToString(audio),
+	}, false)
+	return err
+}
+
+func (x *xfVoiceprint) Delete(ctx context.Context, featureId string) error {
+	_, err := x.call(ctx, &reqInfo{
+		apiName:   "deleteFeature",
+		featureId: featureId,
+	}, false)
+	return err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EnrollConfig controls how a new address is enrolled.
+// Instead of creating the feature from the first unknown recording, Samples recordings are collected
+// (Result 3 with Progress until then). The one with the best snr creates the feature and the others
+// must score at least MinScore against it, otherwise the feature is deleted and the enrollment starts over.
+// If the feature can't be deleted, the next upload of the address deletes it before anything else.
+// A session without a new sample for TTL is dropped. The sessions are kept in memory, at most MaxSessions.
+type EnrollConfig struct {
+	Samples     int           `yaml:"samples"`   // 1 是直接用第一条录音注册
+	MinScore    float64       `yaml:"min_score"` // 0 使用 -s 比对阈值
+	TTL         time.Duration `yaml:"ttl"`
+	MaxSessions int           `yaml:"max_sessions"` // 同时进行的注册数，每个会话保存最多 Samples 条录音
+}
+
+var errTooManyEnrollments = errors.New("too many enrollments in progress, please try again later")
+
+// enrollSample is one accepted recording of an enrollment session.
+type enrollSample struct {
+	jobId string
+	audio []byte // as sent to the voiceprint api
+	snr   float64
+}
+
+type enrollSession struct {
+	samples []enrollSample
+	updated time.Time
+}
+
+type enrollSessions struct {
+	c         EnrollConfig
+	mu        sync.Mutex
+	m         map[string]*enrollSession
+	undeleted map[string]bool // 注册失败后没能删掉的特征
+}
+
+func newEnrollSessions(c EnrollConfig) *enrollSessions {
+	return &enrollSessions{c: c, m: make(map[string]*enrollSession), undeleted: make(map[string]bool)}
+}
+
+// bestSamples keeps the n samples with the best snr, the best first.
+func bestSamples(samples []enrollSample, n int) []enrollSample {
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].snr > samples[j].snr })
+	return samples[:min(n, len(samples))]
+}
+
+// add appends sample to the session of featureId. It returns the number of samples collected,
+// and all of them once there are enough, in which case the session is closed.
+// A new session fails with errTooManyEnrollments if MaxSessions are in progress.
+func (e *enrollSessions) add(featureId string, sample enrollSample, now time.Time) (int, []enrollSample, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k, v := range e.m {
+		if now.Sub(v.updated) > e.c.TTL {
+			delete(e.m, k)
+		}
+	}
+	sess := e.m[featureId]
+	if sess == nil {
+		if len(e.m) >= e.c.MaxSessions {
+			return 0, nil, errTooManyEnrollments
+		}
+		sess = &enrollSession{}
+		e.m[featureId] = sess
+	}
+	sess.samples = append(sess.samples, sample)
+	sess.updated = now
+	n := len(sess.samples)
+	if n < e.c.Samples {
+		return n, nil, nil
+	}
+	delete(e.m, featureId)
+	return n, sess.samples, nil
+}
+
+// restore reopens the session of featureId with the best Samples of samples, after the enrollment failed
+// for another reason than the samples themselves. The next sample completes it again.
+func (e *enrollSessions) restore(featureId string, samples []enrollSample, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sess := e.m[featureId]
+	if sess == nil {
+		sess = &enrollSession{}
+		e.m[featureId] = sess
+	}
+	sess.samples = bestSamples(append(samples, sess.samples...), e.c.Samples)
+	sess.updated = now
+}
+
+// setUndeleted records whether featureId is a feature of a failed enrollment which still has to be deleted.
+func (e *enrollSessions) setUndeleted(featureId string, undeleted bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if undeleted {
+		e.undeleted[featureId] = true
+	} else {
+		delete(e.undeleted, featureId)
+	}
+}
+
+func (e *enrollSessions) isUndeleted(featureId string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.undeleted[featureId]
+}
+
+// enroll creates the feature of j from sample, or adds sample to the enrollment session of j.
+func (s *server) enroll(ctx context.Context, j *uploadJob, sample enrollSample) (int, string) {
+	result := j.result
+	featureId := j.featureId
+	if s.enrolls.c.Samples <= 1 {
+		return s.createFeature(ctx, j, sample.audio)
+	}
+	// 同一段录音重复上传不能算作多条样本
+	if result.Replay != "" {
+		result.Result = 2
+		result.Reason = reasonReplay
+		result.Error = "enrollment samples must be different recordings"
+		return http.StatusBadRequest, result.Error
+	}
+
+	n, samples, err := s.enrolls.add(featureId, sample, time.Now())
+	n = min(n, s.enrolls.c.Samples)
+	if err != nil {
+		log.Println("enroll", featureId, "error:", err)
+		result.Result = 2
+		result.Error = err.Error()
+		return http.StatusServiceUnavailable, result.Error
+	}
+	result.Progress = fmt.Sprintf("%d/%d", n, s.enrolls.c.Samples)
+	if samples == nil {
+		result.Result = 3
+		return http.StatusOK, fmt.Sprintf("enrollment sample %d of %d accepted for %s, please record again", n, s.enrolls.c.Samples, featureId)
+	}
+
+	samples = bestSamples(samples, s.enrolls.c.Samples)
+	log.Println("enroll", featureId, "with job", samples[0].jobId, "of", len(samples), "samples")
+	code, msg := s.createFeature(ctx, j, samples[0].audio)
+	if result.Result != 0 {
+		// 没有创建成功，保留样本，客户端再录一条就会重新注册
+		s.enrolls.restore(featureId, samples, time.Now())
+		return code, msg
+	}
+
+	minScore := s.enrolls.c.MinScore
+	if minScore <= 0 {
+		minScore = s.threshold
+	}
+	for _, sm := range samples[1:] {
+		res, err := s.vp.Verify(ctx, featureId, sm.audio)
+		if err != nil {
+			// 比对调用失败不代表样本不一致：删掉未经检查的特征，保留样本
+			log.Println("verify enrollment sample", sm.jobId, "error:", err)
+			s.enrolls.restore(featureId, samples, time.Now())
+			if derr := s.deleteFeature(ctx, featureId); derr != nil {
+				err = derr
+			}
+			return s.vendorError(result, "verify enrollment sample error: ", err)
+		}
+		switch {
+		case res == nil || res.FeatureId != featureId:
+			log.Println("enrollment sample", sm.jobId, "does not match", featureId)
+		case res.Score >= minScore:
+			continue
+		default:
+			log.Println("enrollment sample", sm.jobId, "score", res.Score, "is lower than", minScore)
+		}
+		if err := s.deleteFeature(ctx, featureId); err != nil {
+			return s.vendorError(result, "", err)
+		}
+		result.Result = 2
+		result.Error = "enrollment samples do not match each other, please enroll again"
+		return http.StatusBadRequest, result.Error
+	}
+	return code, msg
+}
+
+// vendorError fails result with err of a vendor call, msg prefixes the message for the client.
+func (s *server) vendorError(result *UploadResult, msg string, err error) (int, string) {
+	result.Result = 2
+	result.Error = err.Error()
+	if code, ok := vendorStatus(result, err); ok {
+		return code, msg + err.Error()
+	}
+	return http.StatusInternalServerError, msg + err.Error()
+}
+
+// deleteFeature removes a feature which failed the enrollment, also when ctx is done already.
+// Until it succeeds, deleteUndeleted tries again before the address is verified.
+func (s *server) deleteFeature(ctx context.Context, featureId string) error {
+	err := s.vp.Delete(context.WithoutCancel(ctx), featureId)
+	if err != nil && !errors.Is(err, errNoFeature) {
+		log.Println("delete feature error:", err)
+		s.enrolls.setUndeleted(featureId, true)
+		return fmt.Errorf("delete unverified feature: %w", err)
+	}
+	s.enrolls.setUndeleted(featureId, false)
+	return nil
+}
+
+// deleteUndeleted deletes the feature of a failed enrollment of featureId, if there is one,
+// so the address is not verified against it.
+func (s *server) deleteUndeleted(ctx context.Context, featureId string) error {
+	if !s.enrolls.isUndeleted(featureId) {
+		return nil
+	}
+	log.Println("delete feature", featureId, "of a failed enrollment")
+	return s.deleteFeature(ctx, featureId)
+}
+
+func (s *server) createFeature(ctx context.Context, j *uploadJob, audio []byte) (int, string) {
+	result := j.result
+	err := s.vp.Enroll(ctx, j.featureId, j.featureInfo, audio)
+	if err != nil {
+		log.Println("create feature error: ", err.Error())
+		result.Result = 2
+		result.Error = err.Error()
+		if code, ok := vendorStatus(result, err); ok {
+			return code, "create feature error: " + err.Error()
+		}
+		return http.StatusInternalServerError, "create feature error: " + err.Error()
+	}
+	result.Result = 0
+	return http.StatusOK, "create new feature for you: " + j.featureId
+}
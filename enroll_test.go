@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEnrollSessions(t *testing.T) {
+	e := newEnrollSessions(EnrollConfig{Samples: 2, TTL: time.Minute, MaxSessions: 2})
+	now := time.Now()
+	if n, samples, err := e.add("a", enrollSample{jobId: "a1", snr: 20}, now); n != 1 || samples != nil || err != nil {
+		t.Fatalf("first sample: %d %v %v", n, samples, err)
+	}
+	e.add("b", enrollSample{jobId: "b1"}, now)
+	if _, _, err := e.add("c", enrollSample{jobId: "c1"}, now); err != errTooManyEnrollments {
+		t.Fatalf("session over max_sessions: %v", err)
+	}
+	n, samples, err := e.add("a", enrollSample{jobId: "a2", snr: 30}, now)
+	if n != 2 || len(samples) != 2 || err != nil {
+		t.Fatalf("last sample: %d %v %v", n, samples, err)
+	}
+
+	// 注册调用失败后样本还在，下一条录音再次凑齐，只保留 snr 最好的 Samples 条
+	e.restore("a", samples, now)
+	n, samples, _ = e.add("a", enrollSample{jobId: "a3", snr: 10}, now)
+	if n != 3 || len(samples) != 3 {
+		t.Fatalf("after restore: %d %v", n, samples)
+	}
+	e.restore("a", samples, now)
+	if s := e.m["a"].samples; len(s) != 2 || s[0].jobId != "a2" || s[1].jobId != "a1" {
+		t.Fatalf("restored samples %v, want a2 and a1", s)
+	}
+
+	// 过期的会话不占位置
+	if _, _, err := e.add("c", enrollSample{jobId: "c1"}, now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("session after the others expired: %v", err)
+	}
+	if len(e.m) != 1 {
+		t.Errorf("%d sessions left, want 1", len(e.m))
+	}
+}
+
+// fakeVoiceprint scores a recording by its content, see scores.
+type fakeVoiceprint struct {
+	mu        sync.Mutex
+	features  map[string]bool
+	scores    map[string]float64 // audio -> score against any feature
+	verifyErr error
+	deleteErr error
+	deletes   int
+}
+
+func newFakeVoiceprint() *fakeVoiceprint {
+	return &fakeVoiceprint{features: make(map[string]bool), scores: make(map[string]float64)}
+}
+
+func (f *fakeVoiceprint) Verify(ctx context.Context, featureId string, audio []byte) (*VoiceprintResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.verifyErr != nil {
+		return nil, f.verifyErr
+	}
+	if !f.features[featureId] {
+		return nil, errNoFeature
+	}
+	return &VoiceprintResult{FeatureId: featureId, Score: f.scores[string(audio)]}, nil
+}
+
+func (f *fakeVoiceprint) Identify(ctx context.Context, audio []byte) (*VoiceprintResult, error) {
+	return nil, errNoFeature
+}
+
+func (f *fakeVoiceprint) Enroll(ctx context.Context, featureId, featureInfo string, audio []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.features[featureId] = true
+	return nil
+}
+
+func (f *fakeVoiceprint) Delete(ctx context.Context, featureId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deletes++
+	if f.deleteErr != nil {
+		return f.deleteErr
+	}
+	delete(f.features, featureId)
+	return nil
+}
+
+func (f *fakeVoiceprint) has(featureId string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.features[featureId]
+}
+
+func (f *fakeVoiceprint) set(verifyErr, deleteErr error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.verifyErr, f.deleteErr = verifyErr, deleteErr
+}
+
+func newEnrollServer(t *testing.T, vp VoiceprintEngine) *server {
+	conf := defaultConfig()
+	conf.Enroll.Samples = 3
+	return newServer(conf, 0.36, serverDeps{vp: vp, store: newMemStore(10), audio: newFSAudioStore(t.TempDir(), "", "")})
+}
+
+// enrollWith adds the samples with audio a, b ... (snr in that order) and returns the result of the last one.
+func enrollWith(s *server, names ...string) (int, string, *UploadResult) {
+	var code int
+	var msg string
+	var result *UploadResult
+	for i, name := range names {
+		result = &UploadResult{}
+		j := &uploadJob{jobId: name, featureId: "0xabc", featureInfo: "0xabc", result: result}
+		code, msg = s.enroll(context.Background(), j, enrollSample{jobId: name, audio: []byte(name), snr: float64(len(names) - i)})
+	}
+	return code, msg, result
+}
+
+func TestEnroll(t *testing.T) {
+	vp := newFakeVoiceprint()
+	vp.scores = map[string]float64{"a": 1, "b": 0.8, "c": 0.9, "x": 0.1}
+	s := newEnrollServer(t, vp)
+	if code, msg, r := enrollWith(s, "a", "b", "c"); code != http.StatusOK || r.Result != 0 || r.Progress != "3/3" || !vp.has("0xabc") {
+		t.Fatalf("matching samples: %d %s %+v", code, msg, r)
+	}
+
+	// 样本不一致：删掉特征，重新开始
+	vp = newFakeVoiceprint()
+	vp.scores = map[string]float64{"a": 1, "b": 0.8, "x": 0.1}
+	s = newEnrollServer(t, vp)
+	code, msg, r := enrollWith(s, "a", "b", "x")
+	if code != http.StatusBadRequest || !strings.Contains(msg, "do not match") || r.Result != 2 {
+		t.Fatalf("mismatch: %d %s %+v", code, msg, r)
+	}
+	if vp.has("0xabc") || len(s.enrolls.m) != 0 || s.enrolls.isUndeleted("0xabc") {
+		t.Errorf("mismatch left feature %v, %d sessions", vp.has("0xabc"), len(s.enrolls.m))
+	}
+}
+
+func TestEnrollVerifyError(t *testing.T) {
+	vp := newFakeVoiceprint()
+	vp.scores = map[string]float64{"a": 1, "b": 0.8, "c": 0.9, "d": 0.9}
+	s := newEnrollServer(t, vp)
+	quota := &xfError{Api: "searchScoreFea", Code: 11201}
+	vp.set(quota, nil)
+	code, _, r := enrollWith(s, "a", "b", "c")
+	if code != http.StatusServiceUnavailable || r.Result != 2 {
+		t.Fatalf("verify error: %d %+v", code, r)
+	}
+	if vp.has("0xabc") {
+		t.Error("unverified feature is left")
+	}
+	// 每次失败都保留最多 Samples 条样本
+	for i := 0; i < 3; i++ {
+		if code, _, _ := enrollWith(s, "d"); code != http.StatusServiceUnavailable {
+			t.Fatalf("verify error %d: %d", i, code)
+		}
+		if n := len(s.enrolls.m["0xabc"].samples); n != 3 {
+			t.Fatalf("%d samples kept after verify error %d", n, i)
+		}
+	}
+	vp.set(nil, nil)
+	if code, msg, r := enrollWith(s, "d"); code != http.StatusOK || r.Result != 0 || !vp.has("0xabc") {
+		t.Fatalf("after verify error: %d %s %+v", code, msg, r)
+	}
+}
+
+func TestEnrollDeleteError(t *testing.T) {
+	vp := newFakeVoiceprint()
+	vp.scores = map[string]float64{"a": 1, "b": 0.8, "x": 0.1}
+	s := newEnrollServer(t, vp)
+	boom := errors.New("boom")
+	vp.set(nil, boom)
+	code, msg, r := enrollWith(s, "a", "b", "x")
+	if code != http.StatusInternalServerError || !strings.Contains(msg, "boom") || r.Result != 2 {
+		t.Fatalf("delete error: %d %s %+v", code, msg, r)
+	}
+	if !s.enrolls.isUndeleted("0xabc") {
+		t.Fatal("undeleted feature is not recorded")
+	}
+	// 下次上传先删掉特征，删不掉就不比对
+	if err := s.deleteUndeleted(context.Background(), "0xabc"); !errors.Is(err, boom) || !vp.has("0xabc") {
+		t.Fatalf("delete again: %v", err)
+	}
+	vp.set(nil, nil)
+	if err := s.deleteUndeleted(context.Background(), "0xabc"); err != nil || vp.has("0xabc") || s.enrolls.isUndeleted("0xabc") {
+		t.Fatalf("delete at last: %v", err)
+	}
+	deletes := vp.deletes
+	s.deleteUndeleted(context.Background(), "0xabc")
+	if vp.deletes != deletes {
+		t.Error("deleted a feature which is not undeleted")
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayConfig controls the replay detection.
+// The fingerprint of each upload is compared with the uploads of every address in the last Window,
+// a bit error rate below Threshold means the same recording was uploaded again.
+// Action "reject" fails the upload with reason replay, "flag" only records the earlier job in Replay.
+// Each instance indexes its own uploads at once and those of the other instances every Refresh,
+// from the fingerprints archived in the audio store.
+type ReplayConfig struct {
+	Enable    bool          `yaml:"enable"`
+	Action    string        `yaml:"action"`
+	Window    time.Duration `yaml:"window"`
+	Threshold float64       `yaml:"threshold"` // 不同录音约为 0.5，越小误报越少
+	Refresh   time.Duration `yaml:"refresh"`   // 0 只在启动时读取
+}
+
+const (
+	replayReject = "reject"
+	replayFlag   = "flag"
+)
+
+// fingerprint parameters, see Haitsma & Kalker, "A Highly Robust Audio Fingerprinting System".
+// Each 16 ms hop gives a 32 bit sub-fingerprint from the energy of 33 bands between 300 and 3000 Hz.
+const (
+	fpFrame      = 2048
+	fpHop        = 256
+	fpBands      = 33
+	fpMinFreq    = 300
+	fpMaxFreq    = 3000
+	fpMinOverlap = 30 // sub-fingerprints, about 0.5 s
+)
+
+// audioFingerprint computes the sub-fingerprints of 16 kHz mono audio a.
+// The bits are the signs of the band energy differences across frequency and time,
+// which survive re-recording through a speaker, level changes and lossy encoding.
+func audioFingerprint(a *pcmAudio) []uint32 {
+	edges := make([]int, fpBands+1)
+	for i := range edges {
+		f := fpMinFreq * math.Pow(fpMaxFreq/fpMinFreq, float64(i)/fpBands)
+		edges[i] = int(f * fpFrame / float64(a.rate))
+	}
+	window := make([]float64, fpFrame)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/fpFrame)
+	}
+
+	var fp []uint32
+	var prev []float64
+	buf := make([]complex128, fpFrame)
+	for p := 0; p+fpFrame <= len(a.samples); p += fpHop {
+		for i := range buf {
+			buf[i] = complex(float64(a.samples[p+i])*window[i], 0)
+		}
+		fft(buf)
+		energy := make([]float64, fpBands)
+		for b := 0; b < fpBands; b++ {
+			for k := edges[b]; k < max(edges[b+1], edges[b]+1); k++ {
+				v := cmplx.Abs(buf[k])
+				energy[b] += v * v
+			}
+		}
+		if prev != nil {
+			var f uint32
+			for b := 0; b < fpBands-1; b++ {
+				if energy[b]-energy[b+1]-(prev[b]-prev[b+1]) > 0 {
+					f |= 1 << b
+				}
+			}
+			fp = append(fp, f)
+		}
+		prev = energy
+	}
+	return fp
+}
+
+// fft is an in place radix-2 fft, len(x) must be a power of 2.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := x[start+k], x[start+k+size/2]*wk
+				x[start+k], x[start+k+size/2] = u+v, u-v
+				wk *= w
+			}
+		}
+	}
+}
+
+// alignedDistance returns the bit error rate of a and b with b[i] aligned to a[i+off], 1 if they overlap
+// by less than half of the shorter one or fpMinOverlap.
+func alignedDistance(a, b []uint32, off int) float64 {
+	overlap := max(min(len(a), len(b))/2, fpMinOverlap)
+	start, end := max(off, 0), min(len(a), off+len(b))
+	if end-start < overlap {
+		return 1
+	}
+	diff := 0
+	for i := start; i < end; i++ {
+		diff += bits.OnesCount32(a[i] ^ b[i-off])
+	}
+	return float64(diff) / float64(32*(end-start))
+}
+
+func encodeFingerprint(fp []uint32) []byte {
+	b := make([]byte, 4*len(fp))
+	for i, f := range fp {
+		binary.LittleEndian.PutUint32(b[4*i:], f)
+	}
+	return b
+}
+
+func decodeFingerprint(b []byte) []uint32 {
+	fp := make([]uint32, len(b)/4)
+	for i := range fp {
+		fp[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return fp
+}
+
+// replayEntry is the fingerprint of one earlier upload, address is the safeName of the address.
+type replayEntry struct {
+	address string
+	jobId   string
+	t       time.Time
+	fp      []uint32
+}
+
+// fpPosting is where a sub-fingerprint occurs in an entry.
+type fpPosting struct {
+	e   *replayEntry
+	pos int
+}
+
+const (
+	// fpMaxPostings bounds the postings of a sub-fingerprint, more common ones (e.g. silence) are not
+	// indexed nor looked up, they would match every upload.
+	fpMaxPostings = 100
+	// fpMaxCandidates is how many alignments with the most exact sub-fingerprint matches are compared.
+	fpMaxCandidates = 20
+)
+
+// replayIndex keeps the fingerprints of the uploads in the window in memory.
+// Like Haitsma & Kalker, each sub-fingerprint is hashed to the entries and positions where it occurs,
+// so check only compares an upload with the entries sharing sub-fingerprints with it, at the alignments
+// they give, instead of every entry at every alignment.
+type replayIndex struct {
+	c       ReplayConfig
+	mu      sync.Mutex
+	entries []*replayEntry          // 按时间排序
+	jobs    map[string]*replayEntry // jobId
+	hashes  map[uint32][]fpPosting
+}
+
+func newReplayIndex(c ReplayConfig) *replayIndex {
+	return &replayIndex{c: c, jobs: make(map[string]*replayEntry), hashes: make(map[uint32][]fpPosting)}
+}
+
+// check returns the earlier upload e replays, or nil, and adds e to the index.
+// If the upload then fails in a way the client may retry, forget removes e again.
+func (x *replayIndex) check(e replayEntry) *replayEntry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.prune(e.t)
+
+	type candidate struct {
+		e   *replayEntry
+		off int
+	}
+	votes := make(map[candidate]int)
+	for i, f := range e.fp {
+		ps := x.hashes[f]
+		if len(ps) >= fpMaxPostings {
+			continue
+		}
+		for _, p := range ps {
+			votes[candidate{p.e, i - p.pos}]++
+		}
+	}
+	cands := make([]candidate, 0, len(votes))
+	for c := range votes {
+		cands = append(cands, c)
+	}
+	sort.Slice(cands, func(i, j int) bool { return votes[cands[i]] > votes[cands[j]] })
+	if len(cands) > fpMaxCandidates {
+		cands = cands[:fpMaxCandidates]
+	}
+
+	var match *replayEntry
+	best := x.c.Threshold
+	for _, c := range cands {
+		d := alignedDistance(e.fp, c.e.fp, c.off)
+		if d < best {
+			best = d
+			match = c.e
+		}
+	}
+	if match != nil {
+		m := *match
+		match = &m
+		log.Printf("replay: job %s of %s matches job %s of %s, bit error rate %.3f", e.jobId, e.address, m.jobId, m.address, best)
+	}
+	x.add(&e)
+	return match
+}
+
+// forget removes the entry of jobId.
+func (x *replayIndex) forget(jobId string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e := x.jobs[jobId]
+	if e == nil {
+		return
+	}
+	for i := range x.entries {
+		if x.entries[i] == e {
+			x.entries = append(x.entries[:i], x.entries[i+1:]...)
+			break
+		}
+	}
+	x.remove(e)
+}
+
+// add indexes e, x.mu must be held.
+func (x *replayIndex) add(e *replayEntry) {
+	if x.jobs[e.jobId] != nil {
+		return
+	}
+	x.jobs[e.jobId] = e
+	// 其他实例的指纹可能比已有的早
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].t.After(e.t) })
+	x.entries = append(x.entries, nil)
+	copy(x.entries[i+1:], x.entries[i:])
+	x.entries[i] = e
+	for pos, f := range e.fp {
+		if len(x.hashes[f]) < fpMaxPostings {
+			x.hashes[f] = append(x.hashes[f], fpPosting{e, pos})
+		}
+	}
+}
+
+// remove drops the postings of e, which is no longer in entries. x.mu must be held.
+func (x *replayIndex) remove(e *replayEntry) {
+	delete(x.jobs, e.jobId)
+	for _, f := range e.fp {
+		ps := x.hashes[f]
+		n := 0
+		for _, p := range ps {
+			if p.e != e {
+				ps[n] = p
+				n++
+			}
+		}
+		if n == 0 {
+			delete(x.hashes, f)
+		} else if n < len(ps) {
+			x.hashes[f] = ps[:n]
+		}
+	}
+}
+
+// prune removes the entries older than the window, x.mu must be held.
+func (x *replayIndex) prune(now time.Time) {
+	n := 0
+	for n < len(x.entries) && now.Sub(x.entries[n].t) > x.c.Window {
+		x.remove(x.entries[n])
+		n++
+	}
+	x.entries = x.entries[n:]
+}
+
+// refresh adds the fingerprints archived in the window which are not in the index yet: at startup,
+// so a restart does not forget them, and then every Refresh for the uploads of the other instances.
+func (x *replayIndex) refresh(ctx context.Context, store AudioStore, now time.Time) error {
+	objs, err := store.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, o := range objs {
+		parts := strings.Split(o.Key, "/")
+		t := objectTime(o)
+		if len(parts) != 4 || strings.TrimSuffix(parts[3], ".gz") != "fingerprint.bin" || now.Sub(t) > x.c.Window {
+			continue
+		}
+		x.mu.Lock()
+		known := x.jobs[parts[2]] != nil
+		x.mu.Unlock()
+		if known {
+			continue
+		}
+		b, err := store.Get(ctx, o.Key)
+		if err != nil {
+			return err
+		}
+		// janitor 压缩过的指纹
+		if strings.HasSuffix(o.Key, ".gz") {
+			zr, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return err
+			}
+			b, err = io.ReadAll(zr)
+			if err != nil {
+				return err
+			}
+		}
+		x.mu.Lock()
+		x.add(&replayEntry{address: parts[0], jobId: parts[2], t: t, fp: decodeFingerprint(b)})
+		x.mu.Unlock()
+		n++
+	}
+	if n > 0 {
+		log.Println("replay index added", n, "archived fingerprints")
+	}
+	return nil
+}
+
+// refreshLoop calls refresh every Refresh, if it is set.
+func (x *replayIndex) refreshLoop(store AudioStore) {
+	if x.c.Refresh <= 0 {
+		return
+	}
+	for range time.Tick(x.c.Refresh) {
+		err := x.refresh(context.Background(), store, time.Now())
+		if err != nil {
+			log.Println("refresh replay index error:", err)
+		}
+	}
+}
+
+// recordFingerprint archives the fingerprint of j once it is processed, for refresh on the other instances.
+// If j failed because of our limits or the vendor, the fingerprint is dropped instead,
+// so the client can upload the same recording again after Retry-After.
+func (s *server) recordFingerprint(ctx context.Context, j *uploadJob, code int) {
+	if s.replay == nil || j.fingerprint == nil {
+		return
+	}
+	if code >= http.StatusInternalServerError || code == http.StatusTooManyRequests {
+		s.replay.forget(j.jobId)
+		return
+	}
+	err := s.archive.save(ctx, j.address, j.jobId, j.created, "fingerprint.bin", encodeFingerprint(j.fingerprint))
+	if err != nil {
+		log.Println("archive fingerprint error:", err)
+	}
+}
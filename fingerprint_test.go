@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testSpeech is 3 s of noise shaped like syllables, the same seed gives the same recording.
+func testSpeech(seed int64) *pcmAudio {
+	r := rand.New(rand.NewSource(seed))
+	a := &pcmAudio{rate: speechRate, channels: 1, samples: make([]float32, 3*speechRate)}
+	f := 200 + r.Float64()*800
+	for i := range a.samples {
+		if i%4000 == 0 {
+			f = 200 + r.Float64()*800
+		}
+		env := math.Abs(math.Sin(math.Pi * float64(i%4000) / 4000))
+		a.samples[i] = float32(env * (0.3*math.Sin(2*math.Pi*f*float64(i)/speechRate) + 0.1*r.NormFloat64()))
+	}
+	return a
+}
+
+// rerecord plays a back quieter, later and with some noise, like a recording of a speaker.
+func rerecord(a *pcmAudio, shift int) *pcmAudio {
+	r := rand.New(rand.NewSource(99))
+	b := &pcmAudio{rate: a.rate, channels: 1, samples: make([]float32, len(a.samples)+shift)}
+	for i, v := range a.samples {
+		b.samples[i+shift] = 0.5*v + float32(0.005*r.NormFloat64())
+	}
+	return b
+}
+
+func TestReplayIndex(t *testing.T) {
+	x := newReplayIndex(ReplayConfig{Window: time.Hour, Threshold: 0.25})
+	now := time.Now()
+	if m := x.check(replayEntry{address: "a", jobId: "j1", t: now, fp: audioFingerprint(testSpeech(1))}); m != nil {
+		t.Fatalf("first upload matches %s", m.jobId)
+	}
+	if m := x.check(replayEntry{address: "b", jobId: "j2", t: now, fp: audioFingerprint(testSpeech(2))}); m != nil {
+		t.Fatalf("another recording matches %s", m.jobId)
+	}
+	replayed := audioFingerprint(rerecord(testSpeech(1), 1000))
+	m := x.check(replayEntry{address: "c", jobId: "j3", t: now.Add(time.Minute), fp: replayed})
+	if m == nil || m.jobId != "j1" {
+		t.Fatalf("replay matches %v, want j1", m)
+	}
+
+	// 忘掉的和窗口外的都不再匹配
+	x.forget("j1")
+	x.forget("j3")
+	if m := x.check(replayEntry{address: "c", jobId: "j4", t: now.Add(2 * time.Minute), fp: replayed}); m != nil {
+		t.Fatalf("forgotten upload matches %s", m.jobId)
+	}
+	if m := x.check(replayEntry{address: "d", jobId: "j5", t: now.Add(2 * time.Hour), fp: replayed}); m != nil {
+		t.Fatalf("upload out of the window matches %s", m.jobId)
+	}
+	if len(x.entries) != 1 || len(x.jobs) != 1 {
+		t.Errorf("%d entries and %d jobs left, want 1", len(x.entries), len(x.jobs))
+	}
+	for f, ps := range x.hashes {
+		for _, p := range ps {
+			if p.e.jobId != "j5" {
+				t.Fatalf("posting of %s left for %08x", p.e.jobId, f)
+			}
+		}
+	}
+}
+
+func TestRecordFingerprintAfterCancel(t *testing.T) {
+	fs := newFSAudioStore(t.TempDir(), "", "")
+	s := newServer(defaultConfig(), 0.36, serverDeps{asr: testRecognizer("别的"), store: newMemStore(10), audio: ctxAudioStore{fs}})
+	now := time.Now()
+	j := &uploadJob{jobId: "j1", created: now, address: "0xabc", featureId: "0xabc", text: "芝麻开门",
+		audio: encodeWav(testSpeech(1).s16le(), speechRate), result: &UploadResult{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if code, msg := s.run(ctx, j); code != http.StatusBadRequest {
+		t.Fatalf("upload: %d %s", code, msg)
+	}
+	if _, err := fs.Get(context.Background(), archiveKey("0xabc", "j1", now, "fingerprint.bin")); err != nil {
+		t.Errorf("fingerprint: %v", err)
+	}
+}
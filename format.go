@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// upload formats recognized by sniffFormat
+const (
+	formatWav       = "wav"
+	formatWebm      = "webm" // MediaRecorder in chrome/firefox, usually opus
+	formatOggOpus   = "ogg_opus"
+	formatOggVorbis = "ogg_vorbis"
+	formatMp3       = "mp3"
+	formatM4a       = "m4a" // iOS, aac in mp4
+)
+
+var errUnknownFormat = errors.New("unknown audio format")
+
+// sniffFormat detects the container of b by its magic bytes, it returns "" if unknown.
+func sniffFormat(b []byte) string {
+	switch {
+	case len(b) >= 12 && string(b[0:4]) == "RIFF" && string(b[8:12]) == "WAVE":
+		return formatWav
+	case bytes.HasPrefix(b, []byte{0x1a, 0x45, 0xdf, 0xa3}): // EBML
+		return formatWebm
+	case bytes.HasPrefix(b, []byte("OggS")):
+		// 第一页是编码器的标识头
+		head := b[:min(len(b), 512)]
+		if bytes.Contains(head, []byte("OpusHead")) {
+			return formatOggOpus
+		}
+		if bytes.Contains(head, []byte("\x01vorbis")) {
+			return formatOggVorbis
+		}
+		return ""
+	case len(b) >= 12 && string(b[4:8]) == "ftyp":
+		return formatM4a
+	case bytes.HasPrefix(b, []byte("ID3")):
+		return formatMp3
+	case len(b) >= 2 && b[0] == 0xff && b[1]&0xe0 == 0xe0: // mpeg audio frame sync
+		return formatMp3
+	}
+	return ""
+}
+
+// formatExt returns the file extension of format.
+func formatExt(format string) string {
+	switch format {
+	case formatOggOpus, formatOggVorbis:
+		return ".ogg"
+	case "":
+		return ".bin"
+	}
+	return "." + format
+}
+
+// ffmpegFormats are the upload formats only ffmpeg decodes.
+var ffmpegFormats = []string{formatWebm, formatOggOpus, formatMp3, formatM4a}
+
+// findFFmpeg resolves c.FFmpeg, or looks ffmpeg up in PATH if it is empty.
+// Without ffmpeg the MediaRecorder (webm/opus) and iOS (m4a) uploads are rejected, so a missing ffmpeg
+// is an error if c.RequireFFmpeg is true, otherwise it returns "" and only wav and ogg/vorbis work.
+func findFFmpeg(c AudioConfig) (string, error) {
+	name := c.FFmpeg
+	if name == "" {
+		name = "ffmpeg"
+	}
+	p, err := exec.LookPath(name)
+	if err == nil {
+		return p, nil
+	}
+	if c.FFmpeg != "" || c.RequireFFmpeg {
+		return "", fmt.Errorf("ffmpeg is required to decode %v uploads: %w; install it, set audio.ffmpeg, "+
+			"or set audio.require_ffmpeg to false to only accept wav and ogg/vorbis", ffmpegFormats, err)
+	}
+	return "", nil
+}
+
+// decodeAudio decodes b of format into 16 kHz mono audio of at most c.MaxDuration seconds.
+// Wav and ogg vorbis are decoded natively, other formats need ffmpeg (if c.FFmpeg is not empty).
+// A wav decodeWav can't read (μ-law, a-law, adpcm ...) also goes to ffmpeg, unless its rate or channels are rejected.
+func decodeAudio(ctx context.Context, b []byte, format string, c AudioConfig) (*pcmAudio, error) {
+	var a *pcmAudio
+	var err error
+	switch format {
+	case formatWav:
+		a, err = decodeWav(b)
+		if err != nil && c.FFmpeg != "" && !errors.Is(err, errInvalidFormat) {
+			log.Println("decode wav error:", err, "trying ffmpeg")
+			return decodeFFmpeg(ctx, b, format, c)
+		}
+	case formatOggVorbis:
+		a, err = decodeVorbis(b)
+	default:
+		if c.FFmpeg == "" {
+			if format == "" {
+				return nil, errUnknownFormat
+			}
+			return nil, fmt.Errorf("%s audio is not supported without ffmpeg", format)
+		}
+		return decodeFFmpeg(ctx, b, format, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = checkFormat(a.channels, a.rate)
+	if err != nil {
+		return nil, err
+	}
+	// 先检查时长，再做重采样
+	err = checkDuration(a, c.MaxDuration)
+	if err != nil {
+		return nil, err
+	}
+	a.srcRate = a.rate
+	return a.mono().resample(speechRate), nil
+}
+
+// decodeFFmpeg decodes b with ffmpeg, which resamples it already, so the rate of the upload is unknown (srcRate 0).
+func decodeFFmpeg(ctx context.Context, b []byte, format string, c AudioConfig) (*pcmAudio, error) {
+	a, err := ffmpegDecode(ctx, c.FFmpeg, format, b, c.MaxDuration)
+	if err != nil {
+		return nil, err
+	}
+	return a, checkDuration(a, c.MaxDuration)
+}
+
+// checkDuration rejects audio longer than max seconds.
+func checkDuration(a *pcmAudio, max float64) error {
+	if max > 0 && a.duration() > max {
+		return fmt.Errorf("audio is longer than %v seconds", max)
+	}
+	return nil
+}
+
+func decodeVorbis(b []byte) (*pcmAudio, error) {
+	samples, f, err := oggvorbis.ReadAll(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return &pcmAudio{rate: f.SampleRate, channels: f.Channels, samples: samples}, nil
+}
+
+// ffmpegDemuxer is the ffmpeg input format of each upload format, so ffmpeg does not need to probe the pipe.
+var ffmpegDemuxer = map[string]string{
+	formatWav:       "wav",
+	formatWebm:      "matroska",
+	formatOggOpus:   "ogg",
+	formatOggVorbis: "ogg",
+	formatMp3:       "mp3",
+}
+
+// ffmpegDecode converts b to 16 kHz mono pcm with ffmpeg, no shell involved.
+// m4a goes through a temp file because the moov box is often at the end, which a pipe can't seek to.
+// At most maxDuration seconds (and a little more, so checkDuration can tell) are decoded, 0 is no limit.
+func ffmpegDecode(ctx context.Context, ffmpegPath, format string, b []byte, maxDuration float64) (*pcmAudio, error) {
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	var stdin *bytes.Reader
+	if format == formatM4a {
+		f, err := os.CreateTemp("", "vps-*.m4a")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(b)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-i", f.Name())
+	} else {
+		if d, ok := ffmpegDemuxer[format]; ok {
+			args = append(args, "-f", d)
+		}
+		args = append(args, "-i", "pipe:0")
+		stdin = bytes.NewReader(b)
+	}
+	if maxDuration > 0 {
+		args = append(args, "-t", fmt.Sprint(maxDuration+1))
+	}
+	args = append(args, "-f", "s16le", "-acodec", "pcm_s16le", "-ac", "1", "-ar", fmt.Sprint(speechRate), "pipe:1")
+
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return fromS16le(stdout.Bytes(), speechRate), nil
+}
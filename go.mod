@@ -4,7 +4,14 @@ go 1.22.2
 
 require (
 	github.com/gorilla/websocket v1.5.1
+	github.com/jfreymuth/oggvorbis v1.0.5
 	github.com/youthlin/go-lame v0.0.1
+	go.etcd.io/bbolt v1.3.11
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/net v0.17.0 // indirect
+require (
+	github.com/jfreymuth/vorbis v1.0.2 // indirect
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+)
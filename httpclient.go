@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// HTTPConfig controls the http client of the voiceprint api. One client is shared by all calls,
+// so the connections to xfyun are kept alive and reused.
+type HTTPConfig struct {
+	ConnectTimeout  time.Duration `yaml:"connect_timeout"`   // 建立连接和 tls 握手
+	Timeout         time.Duration `yaml:"timeout"`           // 一次请求的总时间，包括读取响应，0 不限制
+	MaxIdleConns    int           `yaml:"max_idle_conns"`    // 保持的空闲连接数
+	IdleConnTimeout time.Duration `yaml:"idle_conn_timeout"` // 空闲连接关闭前的时间
+	Proxy           string        `yaml:"proxy"`             // 代理地址，为空时使用 HTTPS_PROXY 等环境变量
+	CAFile          string        `yaml:"ca_file"`           // 额外信任的 ca 证书 (pem)，用于代理或网关的自签证书
+}
+
+// newHTTPClient builds the client described by c.
+func newHTTPClient(c HTTPConfig) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if c.Proxy != "" {
+		u, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+	tlsConfig := &tls.Config{}
+	if c.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificate found in " + c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	dialer := &net.Dialer{
+		Timeout:   c.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:               proxy,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: c.ConnectTimeout,
+		MaxIdleConns:        c.MaxIdleConns,
+		MaxIdleConnsPerHost: c.MaxIdleConns,
+		IdleConnTimeout:     c.IdleConnTimeout,
+		ForceAttemptHTTP2:   true,
+	}
+	return &http.Client{Transport: transport, Timeout: c.Timeout}, nil
+}
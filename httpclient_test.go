@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPClientProxy(t *testing.T) {
+	// 代理收到的是完整的 url
+	var got string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.String()
+	}))
+	defer proxy.Close()
+	c, err := newHTTPClient(HTTPConfig{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Get("http://api.xf-yun.invalid/v1/private/s782b4996")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got != "http://api.xf-yun.invalid/v1/private/s782b4996" {
+		t.Errorf("proxy got %q", got)
+	}
+
+	if _, err := newHTTPClient(HTTPConfig{Proxy: "://proxy"}); err == nil {
+		t.Error("no error for an invalid proxy")
+	}
+}
+
+func TestHTTPClientCAFile(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+
+	c, err := newHTTPClient(HTTPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := c.Get(ts.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("self signed certificate is trusted without ca_file")
+	}
+	c, err = newHTTPClient(HTTPConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("with ca_file: %v", err)
+	}
+	resp.Body.Close()
+
+	bad := filepath.Join(dir, "bad.pem")
+	os.WriteFile(bad, []byte("not a certificate"), 0600)
+	for _, fp := range []string{bad, filepath.Join(dir, "missing.pem")} {
+		if _, err := newHTTPClient(HTTPConfig{CAFile: fp}); err == nil {
+			t.Errorf("no error for ca_file %s", fp)
+		}
+	}
+}
+
+func TestHTTPClientTimeouts(t *testing.T) {
+	c, err := newHTTPClient(HTTPConfig{ConnectTimeout: 2 * time.Second, Timeout: 100 * time.Millisecond, MaxIdleConns: 7, IdleConnTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := c.Transport.(*http.Transport)
+	if tr.TLSHandshakeTimeout != 2*time.Second || tr.MaxIdleConns != 7 || tr.MaxIdleConnsPerHost != 7 || tr.IdleConnTimeout != time.Minute {
+		t.Errorf("transport %+v", tr)
+	}
+
+	// 响应太慢时整个请求超时
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+	st := time.Now()
+	resp, err := c.Get(ts.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("slow response did not time out")
+	}
+	if d := time.Since(st); d > 2*time.Second || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("slow response failed after %v: %v", d, err)
+	}
+}
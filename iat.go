@@ -5,15 +5,12 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
-	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -27,143 +24,230 @@ import (
  * 错误码链接：https://www.xfyun.cn/document/error-code （code返回错误码时必看）
  * @author iflytek
  */
-var (
-	hostUrl   = "wss://iat-api.xfyun.cn/v2/iat"
-	appid     = "f6e7d8fe"
-	apiSecret = "YmRiZjA5OGE1NmJlZGJhMWFhZDBkMWFk"
-	apiKey    = "6c199ca711eb5007e52b5a13efe55c7b"
-	// file      = "16k_10.pcm" //请填写您的音频文件路径
-)
-
 const (
 	STATUS_FIRST_FRAME    = 0
 	STATUS_CONTINUE_FRAME = 1
 	STATUS_LAST_FRAME     = 2
 )
 
-func iat(fp, language string) (string, error) {
-	// log.Println(HmacWithShaTobase64("hmac-sha256", "hello\nhello", "hello"))
+// iatError is an error of an iat session. Op is where it happened: dial, send or recv;
+// Code is the vendor error code of a result, see the error code link above, with Op empty.
+// It unwraps to Err, or to the kind of Code in xfErrorCodes.
+type iatError struct {
+	Op      string
+	Code    int
+	Message string
+	Sid     string
+	Err     error
+}
+
+func (e *iatError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("iat error %d: %s (sid %s)", e.Code, e.Message, e.Sid)
+	}
+	return "iat " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *iatError) Unwrap() error {
+	if e.Code != 0 {
+		return xfErrorCodes[e.Code]
+	}
+	return e.Err
+}
+
+// iatInterval is the pause between the frames sent by iat, like audio being recorded but faster.
+const iatInterval = 20 * time.Millisecond
+
+// iatReadTimeout is how long Recv waits for a result once the last frame is sent,
+// so a stalled connection fails instead of blocking the job and its iat slot.
+var iatReadTimeout = 15 * time.Second
+
+// iat recognizes the whole pcm. The session is closed when ctx is done, the connection and the
+// sender goroutine are released before it returns on every path.
+func iat(ctx context.Context, c XfyunConfig, pcm []byte, opts IatOptions) (*Transcript, error) {
 	st := time.Now()
+	s, err := dialIat(ctx, c, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.sendAll(sctx, pcm)
+	}()
+
+	for {
+		t, final, err := s.Recv()
+		if err == nil && !final {
+			continue
+		}
+		if err == nil {
+			// 识别可能在音频发完前结束，停止发送
+			cancel()
+			<-sent
+			log.Println("iat result:", t.String(), time.Since(st))
+			return t, nil
+		}
+		s.Close()
+		cancel()
+		serr := <-sent
+		var ie *iatError
+		switch {
+		case ctx.Err() != nil:
+			return nil, &iatError{Op: "recv", Err: ctx.Err()}
+		case errors.As(err, &ie) && ie.Code != 0:
+			return nil, err
+		case serr != nil && !errors.Is(serr, context.Canceled):
+			return nil, serr
+		}
+		return nil, err
+	}
+}
+
+// iatFrameSize is the most audio sent in one frame.
+const iatFrameSize = 12800
+
+// iatFrame builds a frame of audio, the first frame also carries the app id and the business parameters.
+func iatFrame(c XfyunConfig, opts IatOptions, status int, audio []byte) map[string]interface{} {
+	frame := map[string]interface{}{
+		"data": map[string]interface{}{
+			"status":   status,
+			"format":   "audio/L16;rate=16000",
+			"audio":    base64.StdEncoding.EncodeToString(audio),
+			"encoding": "raw",
+		},
+	}
+	if status == STATUS_FIRST_FRAME {
+		frame["common"] = map[string]interface{}{
+			"app_id": c.AppId, //appid 必须带上，只需第一帧发送
+		}
+		frame["business"] = opts.business() //business 参数，只需一帧发送
+	}
+	return frame
+}
+
+// iatStream is an iat session fed with audio as it is recorded, see RecognizeStream.
+// The connection is closed when the context of dialIat is done.
+type iatStream struct {
+	conn    *websocket.Conn
+	c       XfyunConfig
+	opts    IatOptions
+	status  int
+	decoder Decoder
+	stop    func() bool
+	// 只有 Recv 所在的 goroutine 能设置读超时，发送方通过这两个值告诉它音频发完了
+	finished atomic.Bool
+	received atomic.Int64
+}
+
+func dialIat(ctx context.Context, c XfyunConfig, opts IatOptions) (*iatStream, error) {
+	u, err := assembleAuthUrl(c.IatUrl, c.ApiKey, c.ApiSecret)
+	if err != nil {
+		return nil, &iatError{Op: "dial", Err: err}
+	}
 	d := websocket.Dialer{
 		HandshakeTimeout: 5 * time.Second,
 	}
 	//握手并建立websocket 连接
-	conn, _, err := d.Dial(assembleAuthUrl(hostUrl, apiKey, apiSecret), nil)
+	conn, resp, err := d.DialContext(ctx, u, nil)
 	if err != nil {
-		// panic(readResp(resp) + err.Error())
-		return "", err
+		if resp != nil {
+			// 鉴权失败等情况下握手返回的 http 状态
+			if kind := httpStatusError(resp.StatusCode); kind != nil {
+				err = fmt.Errorf("%w: %s: %w", err, resp.Status, kind)
+			} else {
+				err = fmt.Errorf("%w: %s", err, resp.Status)
+			}
+		}
+		return nil, &iatError{Op: "dial", Err: err}
 	}
-	//打开音频文件
-
-	var frameSize = 12800                //每一帧的音频大小
-	var intervel = 20 * time.Millisecond //发送音频间隔
-	//开启协程，发送数据
-	ctx, _ := context.WithCancel(context.Background())
-	defer conn.Close()
-	var status = 0
-	go func() {
-		//	start:
-		audioFile, err := os.Open(fp)
+	s := &iatStream{conn: conn, c: c, opts: opts, status: STATUS_FIRST_FRAME}
+	// ctx 结束时关闭连接，让阻塞的读写返回
+	s.stop = context.AfterFunc(ctx, func() { conn.Close() })
+	return s, nil
+}
+
+func (s *iatStream) Send(pcm []byte) error {
+	for len(pcm) > 0 {
+		n := min(len(pcm), iatFrameSize)
+		err := s.conn.WriteJSON(iatFrame(s.c, s.opts, s.status, pcm[:n]))
 		if err != nil {
-			panic(err)
+			return &iatError{Op: "send", Err: err}
 		}
-		status = STATUS_FIRST_FRAME //音频的状态信息，标识音频是第一帧，还是中间帧、最后一帧
-		//		time.Sleep(20*time.Second)
-		var buffer = make([]byte, frameSize)
-		for {
-			len, err := audioFile.Read(buffer)
-			if err != nil {
-				if err == io.EOF { //文件读取完了，改变status = STATUS_LAST_FRAME
-					status = STATUS_LAST_FRAME
-				} else {
-					panic(err)
-				}
-			}
-			select {
-			case <-ctx.Done():
-				// log.Println("session end ---")
-				return
-			default:
-			}
-			switch status {
-			case STATUS_FIRST_FRAME: //发送第一帧音频，带business 参数
-				frameData := map[string]interface{}{
-					"common": map[string]interface{}{
-						"app_id": appid, //appid 必须带上，只需第一帧发送
-					},
-					"business": map[string]interface{}{ //business 参数，只需一帧发送
-						"language": language, // "zh_cn",
-						"domain":   "iat",
-						"accent":   "mandarin",
-					},
-					"data": map[string]interface{}{
-						"status":   STATUS_FIRST_FRAME,
-						"format":   "audio/L16;rate=16000",
-						"audio":    base64.StdEncoding.EncodeToString(buffer[:len]),
-						"encoding": "raw",
-					},
-				}
-				// log.Println("send first")
-				conn.WriteJSON(frameData)
-				status = STATUS_CONTINUE_FRAME
-			case STATUS_CONTINUE_FRAME:
-				frameData := map[string]interface{}{
-					"data": map[string]interface{}{
-						"status":   STATUS_CONTINUE_FRAME,
-						"format":   "audio/L16;rate=16000",
-						"audio":    base64.StdEncoding.EncodeToString(buffer[:len]),
-						"encoding": "raw",
-					},
-				}
-				conn.WriteJSON(frameData)
-			case STATUS_LAST_FRAME:
-				frameData := map[string]interface{}{
-					"data": map[string]interface{}{
-						"status":   STATUS_LAST_FRAME,
-						"format":   "audio/L16;rate=16000",
-						"audio":    base64.StdEncoding.EncodeToString(buffer[:len]),
-						"encoding": "raw",
-					},
-				}
-				conn.WriteJSON(frameData)
-				// log.Println("send last")
-				return
-			}
+		s.status = STATUS_CONTINUE_FRAME
+		pcm = pcm[n:]
+	}
+	return nil
+}
 
-			//模拟音频采样间隔
-			time.Sleep(intervel)
+func (s *iatStream) CloseSend() error {
+	// 没有音频时也要先发第一帧
+	if s.status == STATUS_FIRST_FRAME {
+		err := s.conn.WriteJSON(iatFrame(s.c, s.opts, STATUS_FIRST_FRAME, nil))
+		if err != nil {
+			return &iatError{Op: "send", Err: err}
 		}
-	}()
+	}
+	s.status = STATUS_LAST_FRAME
+	err := s.conn.WriteJSON(iatFrame(s.c, s.opts, STATUS_LAST_FRAME, nil))
+	if err != nil {
+		return &iatError{Op: "send", Err: err}
+	}
+	s.finished.Store(true)
+	// Recv 可能已经在没有超时地等待，之后一直没有结果就关闭连接
+	n := s.received.Load()
+	time.AfterFunc(iatReadTimeout, func() {
+		if s.received.Load() == n {
+			s.conn.Close()
+		}
+	})
+	return nil
+}
 
-	//获取返回的数据
-	//var decoder Decoder
-	result := ""
-	for {
-		var resp = RespData{}
-		_, msg, err := conn.ReadMessage()
+// sendAll sends pcm a frame every iatInterval and then the last frame.
+func (s *iatStream) sendAll(ctx context.Context, pcm []byte) error {
+	tick := time.NewTicker(iatInterval)
+	defer tick.Stop()
+	for len(pcm) > 0 {
+		n := min(len(pcm), iatFrameSize)
+		err := s.Send(pcm[:n])
 		if err != nil {
-			log.Println("read message error:", err)
-			break
+			return err
 		}
-		json.Unmarshal(msg, &resp)
-		//log.Println(string(msg))
-		// log.Println(resp.Data.Result.String(), resp.Sid)
-		result += resp.Data.Result.String()
-		if resp.Code != 0 {
-			log.Println(resp.Code, resp.Message, time.Since(st))
-		}
-		//decoder.Decode(&resp.Data.Result)
-		if resp.Data.Status == 2 {
-			//cf()
-			//log.Println("final:",decoder.String())
-			// log.Println(resp.Code, resp.Message, time.Since(st))
-			break
+		pcm = pcm[n:]
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
 		}
 	}
+	return s.CloseSend()
+}
 
-	log.Println("lat result:", result)
+func (s *iatStream) Recv() (*Transcript, bool, error) {
+	var resp RespData
+	// 还在发送音频时服务端没有结果是正常的，发完后才限时
+	if s.finished.Load() {
+		s.conn.SetReadDeadline(time.Now().Add(iatReadTimeout))
+	}
+	err := s.conn.ReadJSON(&resp)
+	s.received.Add(1)
+	if err != nil {
+		return nil, false, &iatError{Op: "recv", Err: err}
+	}
+	if resp.Code != 0 {
+		return nil, false, &iatError{Code: resp.Code, Message: resp.Message, Sid: resp.Sid}
+	}
+	s.decoder.Decode(&resp.Data.Result)
+	return s.decoder.Transcript(), resp.Data.Status == STATUS_LAST_FRAME, nil
+}
 
-	return result, nil
+func (s *iatStream) Close() error {
+	s.stop()
+	return s.conn.Close()
 }
 
 type RespData struct {
@@ -179,10 +263,10 @@ type Data struct {
 }
 
 // 创建鉴权url  apikey 即 hmac username
-func assembleAuthUrl(hosturl string, apiKey, apiSecret string) string {
+func assembleAuthUrl(hosturl string, apiKey, apiSecret string) (string, error) {
 	ul, err := url.Parse(hosturl)
 	if err != nil {
-		log.Println(err)
+		return "", err
 	}
 	//签名时间
 	date := time.Now().UTC().Format(time.RFC1123)
@@ -207,7 +291,7 @@ func assembleAuthUrl(hosturl string, apiKey, apiSecret string) string {
 	v.Add("authorization", authorization)
 	//将编码后的字符串url encode后添加到url后面
 	callurl := hosturl + "?" + v.Encode()
-	return callurl
+	return callurl, nil
 }
 
 func HmacWithShaTobase64(algorithm, data, key string) string {
@@ -217,34 +301,45 @@ func HmacWithShaTobase64(algorithm, data, key string) string {
 	return base64.StdEncoding.EncodeToString(encodeData)
 }
 
-func readResp(resp *http.Response) string {
-	if resp == nil {
-		return ""
-	}
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
-	}
-	return fmt.Sprintf("code=%d,body=%s", resp.StatusCode, string(b))
-}
-
-// 解析返回数据，仅供demo参考，实际场景可能与此不同。
+// Decoder assembles the results of one iat session by their sn.
+// With dynamic correction (dwa=wpgs) a result with pgs "rpl" replaces the results rg[0] to rg[1].
 type Decoder struct {
 	results []*Result
 }
 
 func (d *Decoder) Decode(result *Result) {
+	if result.Sn < 0 {
+		return
+	}
 	if len(d.results) <= result.Sn {
 		d.results = append(d.results, make([]*Result, result.Sn-len(d.results)+1)...)
 	}
-	if result.Pgs == "rpl" {
-		for i := result.Rg[0]; i <= result.Rg[1]; i++ {
+	if result.Pgs == "rpl" && len(result.Rg) == 2 {
+		for i := max(result.Rg[0], 0); i <= result.Rg[1] && i < len(d.results); i++ {
 			d.results[i] = nil
 		}
 	}
 	d.results[result.Sn] = result
 }
 
+// Transcript returns the words decoded so far, each with its best candidate.
+func (d *Decoder) Transcript() *Transcript {
+	t := &Transcript{}
+	for _, r := range d.results {
+		if r == nil {
+			continue
+		}
+		for _, ws := range r.Ws {
+			if len(ws.Cw) == 0 {
+				continue
+			}
+			// bg 的单位是帧，1 帧 10 ms
+			t.Words = append(t.Words, Word{Text: ws.Cw[0].W, Confidence: ws.Cw[0].Sc, OffsetMs: ws.Bg * 10})
+		}
+	}
+	return t
+}
+
 func (d *Decoder) String() string {
 	var r string
 	for _, v := range d.results {
@@ -286,6 +381,6 @@ func (w *Ws) String() string {
 }
 
 type Cw struct {
-	Sc int    `json:"sc"`
-	W  string `json:"w"`
+	Sc float64 `json:"sc"`
+	W  string  `json:"w"`
 }
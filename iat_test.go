@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDecoder(t *testing.T) {
+	// 动态修正时 iat 依次返回的结果，rpl 替换 rg 范围内的结果
+	results := []struct {
+		json string
+		want string
+	}{
+		{`{"sn":1,"pgs":"apd","ws":[{"bg":10,"cw":[{"w":"芝","sc":0.5}]}]}`, "芝"},
+		{`{"sn":2,"pgs":"apd","ws":[{"bg":30,"cw":[{"w":"马","sc":0.4}]}]}`, "芝马"},
+		{`{"sn":3,"pgs":"rpl","rg":[1,2],"ws":[{"bg":10,"cw":[{"w":"芝麻","sc":0.9}]},{"bg":60,"cw":[{"w":"开","sc":0.8}]}]}`, "芝麻开"},
+		{`{"sn":4,"pgs":"apd","ws":[{"bg":80,"cw":[{"w":"门","sc":0.9}]}]}`, "芝麻开门"},
+		{`{"sn":5,"pgs":"rpl","rg":[4,4],"ws":[{"bg":80,"cw":[{"w":"门","sc":0.95}]},{"bg":0,"cw":[{"w":"。","sc":0}]}]}`, "芝麻开门。"},
+		// 乱序或越界的 rg 不能让解码出错
+		{`{"sn":7,"pgs":"rpl","rg":[-1,100],"ws":[{"bg":90,"cw":[{"w":"芝麻开门","sc":1}]}]}`, "芝麻开门"},
+	}
+	var d Decoder
+	for i, r := range results {
+		var res Result
+		if err := json.Unmarshal([]byte(r.json), &res); err != nil {
+			t.Fatal(err)
+		}
+		d.Decode(&res)
+		if got := d.String(); got != r.want {
+			t.Fatalf("after result %d: %q, want %q", i, got, r.want)
+		}
+	}
+
+	var d2 Decoder
+	for _, r := range results[:5] {
+		var res Result
+		json.Unmarshal([]byte(r.json), &res)
+		d2.Decode(&res)
+	}
+	tr := d2.Transcript()
+	want := []Word{{"芝麻", 0.9, 100}, {"开", 0.8, 600}, {"门", 0.95, 800}, {"。", 0, 0}}
+	if len(tr.Words) != len(want) {
+		t.Fatalf("words %+v, want %+v", tr.Words, want)
+	}
+	for i, w := range want {
+		if tr.Words[i] != w {
+			t.Errorf("word %d = %+v, want %+v", i, tr.Words[i], w)
+		}
+	}
+	if _, ok := tr.match("芝麻开门"); !ok {
+		t.Errorf("%q does not match", tr.String())
+	}
+}
+
+func TestIatReadTimeout(t *testing.T) {
+	defer func(d time.Duration) { iatReadTimeout = d }(iatReadTimeout)
+	iatReadTimeout = 200 * time.Millisecond
+
+	// 收下所有音频但不返回结果
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		up := websocket.Upgrader{}
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+	c := XfyunConfig{IatUrl: "ws" + strings.TrimPrefix(ts.URL, "http"), AppId: "test", ApiKey: "test", ApiSecret: "test"}
+
+	// 发送音频的时间比超时长，发完后才开始计时
+	pcm := make([]byte, 20*iatFrameSize)
+	st := time.Now()
+	_, err := iat(context.Background(), c, pcm, IatOptions{})
+	d := time.Since(st)
+	if err == nil {
+		t.Fatal("iat without results succeeded")
+	}
+	if sending := 20 * iatInterval; d < sending+iatReadTimeout || d > sending+iatReadTimeout+2*time.Second {
+		t.Errorf("iat failed after %v: %v", d, err)
+	}
+}
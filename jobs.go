@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// jobQueue runs async upload jobs on a fixed number of workers.
+type jobQueue struct {
+	s  *server
+	ch chan *uploadJob
+}
+
+func newJobQueue(s *server, size int) *jobQueue {
+	return &jobQueue{s: s, ch: make(chan *uploadJob, size)}
+}
+
+func (q *jobQueue) start(workers int) {
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+}
+
+// submit saves the pending result and queues the job.
+// If the queue is full, the job is saved as failed and submit returns false.
+func (q *jobQueue) submit(j *uploadJob) bool {
+	q.s.save(j)
+	select {
+	case q.ch <- j:
+		return true
+	default:
+		j.result.Result = 2
+		j.result.Error = "server busy"
+		j.result.Status = statusDone
+		q.s.save(j)
+		return false
+	}
+}
+
+func (q *jobQueue) work() {
+	for j := range q.ch {
+		q.do(j)
+	}
+}
+
+// do runs one job. A panic fails the job instead of killing the server,
+// net/http only recovers the panics of the synchronous uploads.
+func (q *jobQueue) do(j *uploadJob) {
+	ctx := context.Background()
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("job", j.result.ID, "panic:", err, "\n"+string(debug.Stack()))
+			j.result.Result = 2
+			j.result.Error = "internal error"
+			q.s.finish(ctx, j)
+		}
+	}()
+	j.result.Status = statusProcessing
+	q.s.save(j)
+	st := time.Now()
+	code, msg := q.s.run(ctx, j)
+	log.Println("job", j.result.ID, "done:", code, msg, time.Since(st))
+}
+
+func newJobId() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// IatLanguage is the iat language and accent a language parameter of /upload stands for.
+type IatLanguage struct {
+	Language string `yaml:"language"` // zh_cn, en_us, ja_jp ...
+	Accent   string `yaml:"accent"`   // 只对 zh_cn 有效: mandarin, cantonese, lmz (四川话) ...
+}
+
+// IatOptions are the business parameters of an iat session.
+type IatOptions struct {
+	IatLanguage `yaml:",inline"`
+	Domain      string   `yaml:"domain"`
+	VadEos      int      `yaml:"vad_eos"`   // 静音多少 ms 后结束识别
+	Ptt         bool     `yaml:"ptt"`       // 加标点
+	Dwa         bool     `yaml:"dwa"`       // 动态修正 (wpgs)，只支持中文
+	Nunum       bool     `yaml:"nunum"`     // 数字写成阿拉伯数字，只支持中文
+	HotWords    []string `yaml:"hot_words"` // 动态热词 (dhw)
+}
+
+// defaultLanguage is used when an upload has no language parameter,
+// fallbackLanguage when the parameter is unknown and iat.strict_language is off.
+const (
+	defaultLanguage  = "zh"
+	fallbackLanguage = "en"
+)
+
+// iatLanguages maps the language parameter of /upload to iat.
+// Dialects and languages other than zh_cn and en_us must be enabled for the app in the xfyun console.
+var iatLanguages = map[string]IatLanguage{
+	"zh":         {Language: "zh_cn", Accent: "mandarin"},
+	"yue":        {Language: "zh_cn", Accent: "cantonese"},
+	"zh-sichuan": {Language: "zh_cn", Accent: "lmz"},
+	"en":         {Language: "en_us"},
+	"ja":         {Language: "ja_jp"},
+	"ko":         {Language: "ko_kr"},
+	"ru":         {Language: "ru-ru"},
+	// 以前的客户端直接传 iat 的语言
+	"zh_cn": {Language: "zh_cn", Accent: "mandarin"},
+	"en_us": {Language: "en_us"},
+}
+
+var errUnknownLanguage = errors.New("unsupported language")
+
+// chinese reports whether l is in the group of the zh_cn options.
+func (l IatLanguage) chinese() bool {
+	return l.Language == "zh_cn"
+}
+
+// options returns the iat options of the language parameter of an upload:
+// the language of iat.languages or iatLanguages with the options of its group.
+// An unknown language is recognized as fallbackLanguage unless c.StrictLanguage is set.
+func (c IatConfig) options(language string) (IatOptions, error) {
+	if language == "" {
+		language = defaultLanguage
+	}
+	l, ok := c.language(language)
+	if !ok && !c.StrictLanguage {
+		log.Println("unknown language:", language, "using", fallbackLanguage)
+		l, ok = c.language(fallbackLanguage)
+	}
+	if !ok {
+		return IatOptions{}, fmt.Errorf("%w: %s", errUnknownLanguage, language)
+	}
+	o := c.Other
+	if l.chinese() {
+		o = c.Chinese
+	}
+	o.IatLanguage = l
+	return o, nil
+}
+
+func (c IatConfig) language(language string) (IatLanguage, bool) {
+	l, ok := c.Languages[language]
+	if !ok {
+		l, ok = iatLanguages[language]
+	}
+	return l, ok
+}
+
+// validate checks the options of a group, the language is checked in IatConfig.validate.
+func (o IatOptions) validate(name string, chinese bool) error {
+	if o.Domain == "" {
+		return fmt.Errorf("iat.%s.domain is required", name)
+	}
+	// 接口允许 1000 到 10000 ms
+	if o.VadEos < 1000 || o.VadEos > 10000 {
+		return fmt.Errorf("iat.%s.vad_eos must be between 1000 and 10000, got %d", name, o.VadEos)
+	}
+	if !chinese && (o.Dwa || o.Nunum) {
+		return fmt.Errorf("iat.%s: dwa and nunum are only supported for zh_cn", name)
+	}
+	for _, w := range o.HotWords {
+		if w == "" || strings.ContainsAny(w, "|;") {
+			return fmt.Errorf("iat.%s.hot_words: invalid hot word %q", name, w)
+		}
+	}
+	return nil
+}
+
+func (c IatConfig) validate() error {
+	err := c.Chinese.validate("chinese", true)
+	if err != nil {
+		return err
+	}
+	err = c.Other.validate("other", false)
+	if err != nil {
+		return err
+	}
+	for k, l := range c.Languages {
+		if l.Language == "" {
+			return fmt.Errorf("iat.languages.%s.language is required", k)
+		}
+		if l.Accent != "" && !l.chinese() {
+			return fmt.Errorf("iat.languages.%s: accent is only supported for zh_cn", k)
+		}
+	}
+	_, err = c.options(defaultLanguage)
+	return err
+}
+
+// business returns the business parameters of the first frame.
+func (o IatOptions) business() map[string]interface{} {
+	b := map[string]interface{}{
+		"language": o.Language,
+		"domain":   o.Domain,
+		"vad_eos":  o.VadEos,
+	}
+	if o.Accent != "" {
+		b["accent"] = o.Accent
+	}
+	// ptt 默认开启
+	if !o.Ptt {
+		b["ptt"] = 0
+	}
+	if o.Dwa {
+		b["dwa"] = "wpgs"
+	}
+	// nunum 默认开启，只有中文可以设置
+	if o.chinese() && !o.Nunum {
+		b["nunum"] = 0
+	}
+	if len(o.HotWords) > 0 {
+		b["dhw"] = "utf-8;" + strings.Join(o.HotWords, "|")
+	}
+	return b
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestIatOptions(t *testing.T) {
+	c := defaultConfig().Iat
+	c.Languages = map[string]IatLanguage{
+		"henan": {Language: "zh_cn", Accent: "henanese"},
+		"en":    {Language: "en_us", Accent: ""},
+		"fr":    {Language: "fr_fr"},
+	}
+	tests := []struct {
+		language string
+		want     IatLanguage
+		dwa      bool
+	}{
+		{"", IatLanguage{"zh_cn", "mandarin"}, true},
+		{"zh", IatLanguage{"zh_cn", "mandarin"}, true},
+		{"yue", IatLanguage{"zh_cn", "cantonese"}, true},
+		{"en", IatLanguage{"en_us", ""}, false},
+		{"ja", IatLanguage{"ja_jp", ""}, false},
+		// iat 的语言名也可以
+		{"zh_cn", IatLanguage{"zh_cn", "mandarin"}, true},
+		{"en_us", IatLanguage{"en_us", ""}, false},
+		// 配置添加的语言
+		{"henan", IatLanguage{"zh_cn", "henanese"}, true},
+		{"fr", IatLanguage{"fr_fr", ""}, false},
+		// 不认识的语言按英文识别
+		{"de", IatLanguage{"en_us", ""}, false},
+	}
+	for _, tt := range tests {
+		o, err := c.options(tt.language)
+		if err != nil {
+			t.Errorf("%q: %v", tt.language, err)
+			continue
+		}
+		if o.IatLanguage != tt.want || o.Dwa != tt.dwa || o.Domain != "iat" || o.VadEos != 2000 {
+			t.Errorf("%q: %+v, want %+v dwa %v", tt.language, o, tt.want, tt.dwa)
+		}
+	}
+
+	c.StrictLanguage = true
+	if _, err := c.options("de"); !errors.Is(err, errUnknownLanguage) {
+		t.Errorf("unknown language with strict_language: %v", err)
+	}
+	if _, err := c.options("en_us"); err != nil {
+		t.Errorf("en_us with strict_language: %v", err)
+	}
+}
+
+func TestIatBusiness(t *testing.T) {
+	c := defaultConfig().Iat
+	zh, _ := c.options("zh")
+	want := map[string]interface{}{"language": "zh_cn", "domain": "iat", "vad_eos": 2000, "accent": "mandarin", "dwa": "wpgs"}
+	if b := zh.business(); !reflect.DeepEqual(b, want) {
+		t.Errorf("zh business %v, want %v", b, want)
+	}
+
+	c.Chinese.Ptt, c.Chinese.Nunum, c.Chinese.Dwa = false, false, false
+	c.Chinese.HotWords = []string{"芝麻", "开门"}
+	zh, _ = c.options("zh")
+	want = map[string]interface{}{"language": "zh_cn", "domain": "iat", "vad_eos": 2000, "accent": "mandarin", "ptt": 0, "nunum": 0, "dhw": "utf-8;芝麻|开门"}
+	if b := zh.business(); !reflect.DeepEqual(b, want) {
+		t.Errorf("zh business without defaults %v, want %v", b, want)
+	}
+
+	// nunum 只有中文可以设置
+	en, _ := c.options("en")
+	want = map[string]interface{}{"language": "en_us", "domain": "iat", "vad_eos": 2000}
+	if b := en.business(); !reflect.DeepEqual(b, want) {
+		t.Errorf("en business %v, want %v", b, want)
+	}
+}
+
+func TestIatConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(c *IatConfig)
+		ok   bool
+	}{
+		{"default", func(c *IatConfig) {}, true},
+		{"no domain", func(c *IatConfig) { c.Chinese.Domain = "" }, false},
+		{"short vad_eos", func(c *IatConfig) { c.Other.VadEos = 500 }, false},
+		{"long vad_eos", func(c *IatConfig) { c.Chinese.VadEos = 20000 }, false},
+		{"dwa for other", func(c *IatConfig) { c.Other.Dwa = true }, false},
+		{"nunum for other", func(c *IatConfig) { c.Other.Nunum = true }, false},
+		{"empty hot word", func(c *IatConfig) { c.Chinese.HotWords = []string{""} }, false},
+		{"hot word with separator", func(c *IatConfig) { c.Chinese.HotWords = []string{"芝麻|开门"} }, false},
+		{"language without iat language", func(c *IatConfig) { c.Languages = map[string]IatLanguage{"x": {}} }, false},
+		{"accent of other", func(c *IatConfig) {
+			c.Languages = map[string]IatLanguage{"x": {Language: "en_us", Accent: "mandarin"}}
+		}, false},
+		{"dialect", func(c *IatConfig) {
+			c.Languages = map[string]IatLanguage{"henan": {Language: "zh_cn", Accent: "henanese"}}
+		}, true},
+	}
+	for _, tt := range tests {
+		c := defaultConfig().Iat
+		tt.edit(&c)
+		if err := c.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LimitConfig bounds the calls to one xfyun api, see Config.Limits.
+// Calls take a token from a bucket of Burst tokens refilled at Rate per second, and one of MaxInFlight slots
+// until they return. A call waits up to MaxWait for both, then fails with errRateLimited or errTooBusy.
+type LimitConfig struct {
+	Rate        float64       `yaml:"rate"`          // 每秒调用次数，0 不限制
+	Burst       int           `yaml:"burst"`         // 桶容量，0 为 1
+	MaxInFlight int           `yaml:"max_in_flight"` // 并发调用数，0 不限制
+	MaxWait     time.Duration `yaml:"max_wait"`      // 排队等待的最长时间
+}
+
+// limitDefault is the key of Config.Limits used for the apis without their own entry.
+const limitDefault = "default"
+
+var (
+	errRateLimited = errors.New("rate limit exceeded")
+	errTooBusy     = errors.New("too many calls in flight")
+)
+
+// limitError is returned instead of calling Api when its limits are exhausted.
+type limitError struct {
+	Api        string
+	Err        error // errRateLimited or errTooBusy
+	RetryAfter time.Duration
+}
+
+func (e *limitError) Error() string {
+	return e.Api + ": " + e.Err.Error()
+}
+
+func (e *limitError) Unwrap() error {
+	return e.Err
+}
+
+// limitStatus returns the http status and the Retry-After seconds for err if it is a limitError.
+func limitStatus(err error) (int, int, bool) {
+	var le *limitError
+	if !errors.As(err, &le) {
+		return 0, 0, false
+	}
+	code := http.StatusServiceUnavailable
+	if le.Err == errRateLimited {
+		code = http.StatusTooManyRequests
+	}
+	return code, max(int(math.Ceil(le.RetryAfter.Seconds())), 1), true
+}
+
+// limits holds the limiter of every api, shared by all recognizers and voiceprint engines.
+// A nil *limits does not limit anything.
+type limits struct {
+	c  map[string]LimitConfig
+	mu sync.Mutex
+	m  map[string]*limiter
+}
+
+func newLimits(c map[string]LimitConfig) *limits {
+	return &limits{c: c, m: make(map[string]*limiter)}
+}
+
+// acquire waits until api may be called. release must be called when the call returns.
+func (l *limits) acquire(ctx context.Context, api string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	lm := l.m[api]
+	if lm == nil {
+		c, ok := l.c[api]
+		if !ok {
+			c = l.c[limitDefault]
+		}
+		lm = newLimiter(api, c, time.Now())
+		l.m[api] = lm
+	}
+	l.mu.Unlock()
+	return lm.acquire(ctx, time.Now())
+}
+
+type limiter struct {
+	api    string
+	c      LimitConfig
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	slots  chan struct{} // nil 时不限制并发
+}
+
+func newLimiter(api string, c LimitConfig, now time.Time) *limiter {
+	l := &limiter{api: api, c: c, tokens: float64(max(c.Burst, 1)), last: now}
+	if c.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, c.MaxInFlight)
+	}
+	return l
+}
+
+// reserve takes a token and returns how long to wait until it is available.
+func (l *limiter) reserve(now time.Time) (time.Duration, error) {
+	if l.c.Rate <= 0 {
+		return 0, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = min(float64(max(l.c.Burst, 1)), l.tokens+now.Sub(l.last).Seconds()*l.c.Rate)
+	l.last = now
+	var wait time.Duration
+	if l.tokens < 1 {
+		wait = time.Duration((1 - l.tokens) / l.c.Rate * float64(time.Second))
+	}
+	if wait > l.c.MaxWait {
+		return 0, &limitError{Api: l.api, Err: errRateLimited, RetryAfter: wait}
+	}
+	l.tokens--
+	return wait, nil
+}
+
+// unreserve gives back the token of a call which was not made.
+func (l *limiter) unreserve() {
+	if l.c.Rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	l.tokens++
+	l.mu.Unlock()
+}
+
+func (l *limiter) acquire(ctx context.Context, now time.Time) (func(), error) {
+	deadline := time.NewTimer(l.c.MaxWait)
+	defer deadline.Stop()
+	wait, err := l.reserve(now)
+	if err != nil {
+		return nil, err
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			l.unreserve()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+	// 等待正在进行的调用结束
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		l.unreserve()
+		return nil, ctx.Err()
+	case <-deadline.C:
+		l.unreserve()
+		// 不知道什么时候有空位，让客户端过一会再试
+		return nil, &limitError{Api: l.api, Err: errTooBusy, RetryAfter: max(l.c.MaxWait, time.Second)}
+	}
+}
+
+func (l *limiter) release() {
+	<-l.slots
+}
+
+// limitedStream is a recognition session holding an in-flight slot of iat until it is closed.
+type limitedStream struct {
+	RecognizeStream
+	once    sync.Once
+	release func()
+}
+
+func (s *limitedStream) Close() error {
+	s.once.Do(s.release)
+	return s.RecognizeStream.Close()
+}
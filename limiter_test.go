@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLimiterRate(t *testing.T) {
+	now := time.Now()
+	l := newLimiter("searchFea", LimitConfig{Rate: 10, Burst: 2}, now)
+	for i := 0; i < 2; i++ {
+		if wait, err := l.reserve(now); wait != 0 || err != nil {
+			t.Fatalf("call %d of the burst: wait %v, %v", i, wait, err)
+		}
+	}
+	_, err := l.reserve(now)
+	var le *limitError
+	if !errors.As(err, &le) || le.Err != errRateLimited || le.RetryAfter != 100*time.Millisecond {
+		t.Fatalf("call over the burst: %v", err)
+	}
+	if code, retryAfter, ok := limitStatus(err); !ok || code != http.StatusTooManyRequests || retryAfter != 1 {
+		t.Errorf("limitStatus = %d %d %v", code, retryAfter, ok)
+	}
+	// 被拒绝的调用不消耗令牌
+	if wait, err := l.reserve(now.Add(100 * time.Millisecond)); wait != 0 || err != nil {
+		t.Fatalf("call after refill: wait %v, %v", wait, err)
+	}
+
+	// 在 MaxWait 内可以排队
+	l = newLimiter("searchFea", LimitConfig{Rate: 10, Burst: 1, MaxWait: time.Second}, now)
+	l.reserve(now)
+	if wait, err := l.reserve(now); wait != 100*time.Millisecond || err != nil {
+		t.Fatalf("queued call: wait %v, %v", wait, err)
+	}
+	if wait, err := l.reserve(now); wait != 200*time.Millisecond || err != nil {
+		t.Fatalf("second queued call: wait %v, %v", wait, err)
+	}
+	l.unreserve()
+	if wait, _ := l.reserve(now); wait != 200*time.Millisecond {
+		t.Errorf("call after unreserve: wait %v", wait)
+	}
+}
+
+func TestLimiterInFlight(t *testing.T) {
+	l := newLimits(map[string]LimitConfig{
+		limitDefault: {MaxInFlight: 1, MaxWait: 50 * time.Millisecond},
+		"iat":        {},
+	})
+	ctx := context.Background()
+	release, err := l.acquire(ctx, "searchFea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 其他接口不受影响
+	for i := 0; i < 3; i++ {
+		r, err := l.acquire(ctx, "iat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r()
+	}
+	st := time.Now()
+	_, err = l.acquire(ctx, "searchFea")
+	if d := time.Since(st); d < 50*time.Millisecond {
+		t.Errorf("busy call failed after %v, want MaxWait", d)
+	}
+	if code, retryAfter, ok := limitStatus(err); !errors.Is(err, errTooBusy) || code != http.StatusServiceUnavailable || retryAfter != 1 || !ok {
+		t.Fatalf("busy call: %v, status %d %d", err, code, retryAfter)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := l.acquire(cctx, "searchFea"); err != context.Canceled {
+		t.Errorf("canceled call: %v", err)
+	}
+
+	release()
+	release, err = l.acquire(ctx, "searchFea")
+	if err != nil {
+		t.Fatalf("call after release: %v", err)
+	}
+	release()
+
+	var none *limits
+	if r, err := none.acquire(ctx, "iat"); err != nil {
+		t.Errorf("nil limits: %v", err)
+	} else {
+		r()
+	}
+}
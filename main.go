@@ -2,98 +2,225 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/youthlin/go-lame"
 )
 
 var port = flag.String("p", "8888", "listen port")
 var gid = flag.String("g", "group_fzm", "group id")
 var score = flag.Float64("s", 0.36, "score threshold")
 var path = flag.String("f", "./audio_files", "audio file path")
+var confPath = flag.String("c", "", "config file path")
+var useTLS = flag.Bool("tls", false, "serve https, see tls section of config")
+var mockPath = flag.String("mock", "", "mock script file, use a local fake xfyun server instead of the real one")
 
 func main() {
 	flag.Parse()
+	conf, err := loadConfig(*confPath)
+	if err != nil {
+		log.Fatal("load config: ", err)
+	}
+	if *useTLS {
+		conf.TLS.Enable = true
+	}
+	if *mockPath != "" {
+		err = useMock(conf, *mockPath)
+		if err != nil {
+			log.Fatal("start mock server: ", err)
+		}
+	}
+	err = conf.validate()
+	if err != nil {
+		log.Fatal(err)
+	}
 	os.Mkdir(*path, 0755)
-	httpServer()
-}
+	store, err := newResultStore(conf.Store)
+	if err != nil {
+		log.Fatal("open result store: ", err)
+	}
+	defer store.Close()
+	go evictLoop(store, conf.Store.TTL, conf.Store.EvictInterval)
 
-func httpServer() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/upload", uploadHandler)
-	mux.HandleFunc("/upload/result", resultHandler)
-	fmt.Println("Starting HTTP server...")
-	err := http.ListenAndServe(":"+*port, mux)
+	audioStore, err := newAudioStore(conf.AudioStore, *path)
 	if err != nil {
-		fmt.Println(err)
+		log.Fatal("open audio store: ", err)
+	}
+	conf.Audio.FFmpeg, err = findFFmpeg(conf.Audio)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.Audio.FFmpeg == "" {
+		log.Println("WARNING: ffmpeg not found, webm/opus, ogg/opus, mp3 and m4a uploads will be rejected")
+	} else {
+		log.Println("ffmpeg:", conf.Audio.FFmpeg)
+	}
+	lim := newLimits(conf.Limits)
+	client, err := newHTTPClient(conf.Xfyun.HTTP)
+	if err != nil {
+		log.Fatal("xfyun http client: ", err)
 	}
-	fmt.Println("HTTP server stopped.")
-}
 
-func hpptsServer() {
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/result", resultHandler)
-	cfg := &tls.Config{
-		MinVersion:               tls.VersionTLS12,
-		PreferServerCipherSuites: true,
+	s := newServer(conf, *score, serverDeps{
+		asr:   newXfRecognizer(conf.Xfyun, lim),
+		vp:    newXfVoiceprint(conf.Xfyun, *gid, lim, client),
+		store: store,
+		audio: audioStore,
+	})
+	go s.archive.janitor()
+	if s.replay != nil {
+		err = s.replay.refresh(context.Background(), audioStore, time.Now())
+		if err != nil {
+			log.Println("load replay index error:", err)
+		}
+		go s.replay.refreshLoop(audioStore)
 	}
-	server := &http.Server{
-		Addr:      ":443",
-		TLSConfig: cfg,
+	s.startJobs(conf.Jobs.Queue, conf.Jobs.Workers)
+
+	mux := s.newMux(conf.TLS.Enable && conf.TLS.ClientCAFile != "")
+	if conf.TLS.Enable {
+		httpsServer(conf.TLS, mux)
+	} else {
+		httpServer(mux)
 	}
+}
 
-	fmt.Println("Starting HTTPS server...")
-	err := server.ListenAndServeTLS("server.crt", "server.key")
-	if err != nil {
-		fmt.Println(err)
+// server handles the http api, the vendors and the stores are injected by newServer.
+type server struct {
+	asr   SpeechRecognizer
+	vp    VoiceprintEngine
+	store ResultStore
+	jobs  *jobQueue
+
+	async       bool          // 默认异步处理 upload
+	jobTimeout  time.Duration // 一次上传的处理时间上限
+	threshold   float64       // 声纹比对分数阈值
+	archive     *archive
+	reviewToken string        // /review 的 bearer token，为空时关闭
+	urlExpiry   time.Duration // /review 返回的下载链接有效期
+	audio       AudioConfig   // 解码设置，ffmpeg 为空时只支持 wav 和 ogg/vorbis
+	vad         VADConfig
+	quality     QualityConfig
+	mp3         MP3Config
+	vpEncoding  string       // 声纹接口的音频编码，encodingLame 或 encodingRaw
+	replay      *replayIndex // 重放检测，nil 时关闭
+	challenges  *challengeStore
+	enrolls     *enrollSessions
+	iat         IatConfig
+}
+
+// serverDeps are what a server is built on besides its config, main passes the xfyun engines
+// and the configured stores, tests pass fakes.
+type serverDeps struct {
+	asr   SpeechRecognizer
+	vp    VoiceprintEngine
+	store ResultStore
+	audio AudioStore // 上传录音和结果的归档
+}
+
+// newServer builds the server of a validated conf, conf.Audio.FFmpeg is the path found by findFFmpeg.
+// threshold is the voiceprint score threshold. The jobs, the archive janitor and the replay refresh
+// are started by the caller.
+func newServer(conf *Config, threshold float64, d serverDeps) *server {
+	s := &server{
+		asr:         d.asr,
+		vp:          d.vp,
+		store:       d.store,
+		async:       conf.Jobs.Async,
+		jobTimeout:  conf.Jobs.Timeout,
+		threshold:   threshold,
+		archive:     newArchive(d.audio, conf.Archive),
+		reviewToken: conf.AudioStore.ReviewToken,
+		urlExpiry:   conf.AudioStore.URLExpiry,
+		audio:       conf.Audio,
+		vad:         conf.VAD,
+		quality:     conf.Quality,
+		mp3:         conf.MP3,
+		vpEncoding:  conf.Xfyun.VrgEncoding,
+		challenges:  newChallengeStore(conf.Challenge),
+		enrolls:     newEnrollSessions(conf.Enroll),
+		iat:         conf.Iat,
+	}
+	if conf.Replay.Enable {
+		s.replay = newReplayIndex(conf.Replay)
 	}
+	return s
 }
 
-type UploadResult struct {
-	ID        string // upload id
-	Result    int    // 0 is create ok; 1 is recongition ok; others is error
-	Error     string // error info
-	Timestamp int    // seconds from 1970-1-1
+func (s *server) startJobs(queue, workers int) {
+	s.jobs = newJobQueue(s, queue)
+	s.jobs.start(workers)
 }
 
-func wav2mp3(b []byte) ([]byte, error) {
-	rd := bytes.NewReader(b)
-	wavHeader, err := lame.ReadWavHeader(rd)
-	if err != nil {
-		log.Println("Failed to read wav header")
-		return nil, err
+// newMux registers the api, if requireCert is true /upload needs a verified client certificate.
+func (s *server) newMux(requireCert bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	upload := http.Handler(http.HandlerFunc(s.uploadHandler))
+	if requireCert {
+		upload = requireClientCert(upload)
+	}
+	mux.Handle("/upload", upload)
+	challenge := http.Handler(http.HandlerFunc(s.challengeHandler))
+	if requireCert {
+		challenge = requireClientCert(challenge)
 	}
+	mux.Handle("/challenge", challenge)
+	mux.HandleFunc("/upload/result", s.resultHandler)
+	stream := http.Handler(http.HandlerFunc(s.streamHandler))
+	if requireCert {
+		stream = requireClientCert(stream)
+	}
+	mux.Handle("/stream", stream)
+	if s.reviewToken != "" {
+		mux.HandleFunc("/review", s.reviewHandler)
+	}
+	// 本地存储的签名下载链接
+	if h, ok := s.archive.store.(http.Handler); ok {
+		mux.Handle("/audio", h)
+	}
+	return mux
+}
 
-	buf := new(bytes.Buffer)
-	wr, err := lame.NewWriter(buf)
+func httpServer(h http.Handler) {
+	fmt.Println("Starting HTTP server...")
+	err := http.ListenAndServe(":"+*port, h)
 	if err != nil {
-		log.Println("Failed to create lame writer")
-		return nil, err
-	}
-	wr.EncodeOptions = wavHeader.ToEncodeOptions()
-	wr.EncodeOptions.InBitsPerSample = 16
-	wr.EncodeOptions.InSampleRate = 16000
-	wr.EncodeOptions.InNumChannels = 1
-	io.Copy(wr, rd)
-	return buf.Bytes(), nil
+		fmt.Println(err)
+	}
+	fmt.Println("HTTP server stopped.")
 }
 
-var resultMap = make(map[string]*UploadResult)
+type UploadResult struct {
+	ID         string // upload id, generated for async uploads without id
+	Job        string // job id, the recordings are archived under <address>/<yyyy-mm-dd>/<job id>/
+	Result     int    // 0 is create ok; 1 is recongition ok; 3 is enrollment sample accepted, upload another; others is error
+	Error      string // error info
+	Timestamp  int    // seconds from 1970-1-1
+	Status     string // pending, processing or done
+	SpeechMs   int    // speech duration found by vad, 0 if vad is off
+	Reason     string // why the audio is rejected before recognition, e.g. too_short, too_quiet, clipped, noisy, replay
+	Replay     string // job id of the earlier upload with the same recording, if replay detection is on
+	Progress   string // enrollment samples collected, e.g. 2/3
+	Transcript string // iat result
+	RetryAfter int    // seconds to wait before uploading again, when the xfyun limits are exhausted
+}
 
-func resultHandler(w http.ResponseWriter, r *http.Request) {
+const (
+	statusPending    = "pending"
+	statusProcessing = "processing"
+	statusDone       = "done"
+)
+
+func (s *server) resultHandler(w http.ResponseWriter, r *http.Request) {
 	// 设置CORS头
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
@@ -107,9 +234,20 @@ func resultHandler(w http.ResponseWriter, r *http.Request) {
 		log.Println("Missing address parameter")
 		return
 	}
-	result, ok := resultMap[address]
-	if !ok {
-		result = &UploadResult{Result: -1, Error: "sorry, no result for the address:" + address}
+	// 不带 id 时返回最近一次结果
+	id := r.URL.Query().Get("id")
+	var result *UploadResult
+	var err error
+	if id == "" {
+		result, err = s.store.Latest(address)
+	} else {
+		result, err = s.store.Get(address, id)
+	}
+	if err == errNoResult {
+		result = &UploadResult{ID: id, Result: -1, Error: "sorry, no result for the address:" + address}
+	} else if err != nil {
+		log.Println("get result error:", err)
+		result = &UploadResult{Result: -1, Error: err.Error()}
 	}
 	data, err := json.Marshal(result)
 	if err != nil {
@@ -118,7 +256,7 @@ func resultHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) uploadHandler(w http.ResponseWriter, r *http.Request) {
 	// 设置CORS头
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
@@ -127,167 +265,363 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	job := s.newUploadJob(w, r)
+	if job == nil {
+		return
+	}
+	async := s.async
+	if v := r.URL.Query().Get("async"); v != "" {
+		async = v == "1" || v == "true"
+	}
+
+	log.Println("job:", job.jobId, "id:", job.result.ID, "address:", job.address, "featureId:", job.featureId, "language:", job.language, "text:", job.text, "async:", async)
+
+	// 读取请求体
+	defer r.Body.Close()
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.audio.MaxBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request body is larger than "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		}
+		log.Println("Failed to read request body:", err)
+		job.result.Result = 2
+		job.result.Error = "failed to read request body"
+		job.result.Status = statusDone
+		s.save(job)
+		s.restoreChallenge(job)
+		return
+	}
+	job.audio = b
+
+	if async {
+		if job.result.ID == "" {
+			job.result.ID = job.jobId
+		}
+		job.result.Result = -1
+		job.result.Status = statusPending
+		// 提交后 result 归 worker 所有，先序列化
+		data, _ := json.Marshal(job.result)
+		if !s.jobs.submit(job) {
+			s.restoreChallenge(job)
+			http.Error(w, "server busy, try again later", http.StatusServiceUnavailable)
+			log.Println("job queue full, reject", job.result.ID)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(data)
+		return
+	}
+
+	code, msg := s.run(r.Context(), job)
+	if job.result.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(job.result.RetryAfter))
+	}
+	if code != http.StatusOK {
+		http.Error(w, msg, code)
+		return
+	}
+	w.Write([]byte(msg))
+}
+
+// newUploadJob reads the query of an /upload or /stream request.
+// It replies the error and returns nil if the address is missing, the language is not supported
+// or the challenge nonce is not valid.
+func (s *server) newUploadJob(w http.ResponseWriter, r *http.Request) *uploadJob {
 	address := r.URL.Query().Get("address")
 	if address == "" {
 		http.Error(w, "Missing address parameter", http.StatusBadRequest)
 		log.Println("Missing address parameter")
-		return
+		return nil
+	}
+	language := r.URL.Query().Get("language")
+	iatOptions, err := s.iat.options(language)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println(err, "address:", address)
+		return nil
 	}
-	featureInfo := address
 	featureId := address
 	if len(address) > 32 {
 		featureId = address[:32]
 	}
-	id := r.URL.Query().Get("id")
-	language := r.URL.Query().Get("language")
-	text := r.URL.Query().Get("text")
+	now := time.Now()
+	jobId := newJobId()
+	job := &uploadJob{
+		jobId:       jobId,
+		created:     now,
+		address:     address,
+		featureId:   featureId,
+		featureInfo: address,
+		language:    language,
+		iatOptions:  iatOptions,
+		text:        r.URL.Query().Get("text"),
+		result:      &UploadResult{ID: r.URL.Query().Get("id"), Job: jobId, Timestamp: int(now.Unix())},
+	}
+	// 服务端下发的挑战短语代替客户端的 text，nonce 只能用一次，上传没有被处理时还回去
+	var chErr error
+	if nonce := r.URL.Query().Get("nonce"); nonce != "" {
+		job.challenge, chErr = s.challenges.take(nonce, address, now)
+		if chErr == nil {
+			job.text = job.challenge.Text
+		}
+	} else if s.challenges.c.Require {
+		chErr = errMissingNonce
+	}
+	if chErr != nil {
+		http.Error(w, chErr.Error(), http.StatusBadRequest)
+		log.Println("challenge error:", chErr, "address:", address)
+		job.result.Result = 2
+		job.result.Reason = reasonChallenge
+		job.result.Error = chErr.Error()
+		job.result.Status = statusDone
+		s.save(job)
+		return nil
+	}
+	return job
+}
 
-	result := &UploadResult{ID: id, Timestamp: int(time.Now().Unix())}
-	defer func() {
-		resultMap[address] = result
-	}()
+// uploadJob is one check-in attempt of an address.
+type uploadJob struct {
+	jobId       string // unique id of the attempt, also the archive key prefix
+	created     time.Time
+	address     string
+	featureId   string
+	featureInfo string
+	language    string
+	iatOptions  IatOptions
+	text        string
+	challenge   *challenge // taken by the upload, given back if the upload is not processed
+	audio       []byte
+	transcript  *Transcript // iat result of /stream, process calls iat if nil
+	fingerprint []uint32    // replay fingerprint of the speech, set by process
+	result      *UploadResult
+}
+
+func (s *server) save(j *uploadJob) {
+	err := s.store.Put(j.address, j.result)
+	if err != nil {
+		log.Println("save result error:", err)
+	}
+}
 
-	log.Println("id:", id, "address:", address, "featureId:", featureId, "language:", language, "text:", text)
+// run processes the job within jobTimeout and saves the result, it returns the http status code and message for the client.
+func (s *server) run(ctx context.Context, j *uploadJob) (int, string) {
+	pctx, cancel := context.WithTimeout(ctx, s.jobTimeout)
+	defer cancel()
+	code, msg := s.process(pctx, j)
+	// 超时或者客户端断开后指纹和结果也要保存
+	wctx := context.WithoutCancel(ctx)
+	s.recordFingerprint(wctx, j, code)
+	s.finish(wctx, j)
+	return code, msg
+}
 
-	// 读取请求体
-	defer r.Body.Close()
-	b, err := io.ReadAll(r.Body)
+// finish marks the job done and saves the result.
+func (s *server) finish(ctx context.Context, j *uploadJob) {
+	j.result.Status = statusDone
+	s.save(j)
+	// 因为限流没有调用接口，同一个 nonce 可以重试
+	if j.result.RetryAfter > 0 {
+		s.restoreChallenge(j)
+	}
+	err := s.archive.saveResult(ctx, j.address, j.jobId, j.created, j.result)
 	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
-		log.Println("Failed to read request body")
-		result.Result = 2
-		result.Error = "failed to read request body"
-		return
+		log.Println("archive result error:", err)
 	}
+}
 
-	iat_result, err := do_iat(b, address, language)
+// restoreChallenge gives the nonce of j back, see challengeStore.restore.
+func (s *server) restoreChallenge(j *uploadJob) {
+	if j.challenge != nil {
+		s.challenges.restore(j.challenge, time.Now())
+		j.challenge = nil
+	}
+}
+
+func (s *server) process(ctx context.Context, j *uploadJob) (int, string) {
+	result := j.result
+	featureId := j.featureId
+	text := j.text
+
+	a, err := s.decode(ctx, j)
 	if err != nil {
-		http.Error(w, "iat error", http.StatusInternalServerError)
-		log.Println("iat error:", err.Error())
+		log.Println("decode audio error:", err.Error())
 		result.Result = 2
-		result.Error = "iat error " + err.Error()
-		return
+		result.Error = "decode audio error " + err.Error()
+		return http.StatusBadRequest, "Failed to decode audio"
+	}
+	speech := a
+	if s.vad.Enable {
+		speech, result.SpeechMs = trimSilence(a, s.vad)
+		log.Println("speech:", result.SpeechMs, "ms, trimmed to", speech.duration(), "s")
+		if result.SpeechMs == 0 {
+			result.Result = 2
+			result.Reason = reasonNoSpeech
+			result.Error = "no speech detected"
+			return http.StatusBadRequest, "no speech detected"
+		}
+	}
+	// snr 也用来挑选注册样本
+	q := analyzeQuality(a, speech, result.SpeechMs)
+	if s.quality.Enable {
+		log.Printf("quality: %+v", *q)
+		reason, msg := q.check(s.quality)
+		if reason != "" {
+			result.Result = 2
+			result.Reason = reason
+			result.Error = msg
+			return http.StatusBadRequest, msg
+		}
 	}
-	iat_result = strings.ReplaceAll(iat_result, " ", "")
-	text = strings.ReplaceAll(text, " ", "")
-	if !strings.Contains(iat_result, text) {
-		http.Error(w, "iat result is "+iat_result+" not match "+text, http.StatusBadRequest)
+	if s.replay != nil {
+		j.fingerprint = audioFingerprint(speech)
+		if m := s.replay.check(replayEntry{address: safeName(j.address), jobId: j.jobId, t: j.created, fp: j.fingerprint}); m != nil {
+			result.Replay = m.jobId
+			if s.replay.c.Action == replayReject {
+				result.Result = 2
+				result.Reason = reasonReplay
+				result.Error = "the recording was uploaded before"
+				return http.StatusBadRequest, result.Error
+			}
+		}
+	}
+	pcm := speech.s16le()
+
+	transcript := j.transcript
+	if transcript == nil {
+		transcript, err = s.asr.Recognize(ctx, pcm, j.iatOptions)
+		if err != nil {
+			log.Println("iat error:", err.Error())
+			result.Result = 2
+			result.Error = "iat error " + err.Error()
+			if code, ok := vendorStatus(result, err); ok {
+				return code, result.Error
+			}
+			return http.StatusInternalServerError, "iat error"
+		}
+	}
+	iat_result := strings.ReplaceAll(transcript.String(), " ", "")
+	result.Transcript = iat_result
+	words, ok := transcript.match(text)
+	if !ok {
 		result.Result = 2
 		result.Error = "iat result is " + iat_result + " not match " + text
-		return
+		return http.StatusBadRequest, "iat result is " + iat_result + " not match " + text
+	}
+	if s.iat.MinConfidence > 0 {
+		if w := unclear(words, s.iat.MinConfidence); w != nil {
+			log.Printf("word %q at %d ms has confidence %v", w.Text, w.OffsetMs, w.Confidence)
+			result.Result = 2
+			result.Error = "iat is not sure about " + w.Text + ", please read " + text + " clearly"
+			return http.StatusBadRequest, result.Error
+		}
 	}
 
-	// wav to mp3
-	buf, err := wav2mp3(b)
-	if err != nil {
-		http.Error(w, "Failed to convert wav to mp3", http.StatusInternalServerError)
-		log.Println("Failed to convert wav to mp3", len(buf))
-		result.Result = 2
-		result.Error = "failed to convert wav to mp3"
-		return
+	// pcm to mp3, unless the voiceprint api takes raw pcm
+	buf := pcm
+	if s.vpEncoding != encodingRaw {
+		st := time.Now()
+		mp3 := new(bytes.Buffer)
+		err = encodeMp3(mp3, speech, s.mp3)
+		if err != nil {
+			log.Println("Failed to convert pcm to mp3", err)
+			result.Result = 2
+			result.Error = "failed to convert pcm to mp3"
+			return http.StatusInternalServerError, "Failed to convert pcm to mp3"
+		}
+		buf = mp3.Bytes()
+		log.Println("mp3:", len(pcm), "->", len(buf), "bytes in", time.Since(st))
 	}
-	// mp3 data to base64 encode
-	audio := base64.StdEncoding.EncodeToString(buf)
 
-	// first, use searchScoreFea(1:1) to find featureId
-	ri := &reqInfo{
-		groupId:   *gid,
-		apiName:   "searchScoreFea",
-		featureId: featureId,
-		audio:     audio,
+	err = s.deleteUndeleted(ctx, featureId)
+	if err != nil {
+		return s.vendorError(result, "", err)
 	}
 
-	res, code, err := vrg(ri)
+	// first, use searchScoreFea(1:1) to find featureId
+	res, err := s.vp.Verify(ctx, featureId, buf)
 	if err != nil {
 		log.Println("Failed to search srore feature", err.Error())
-		if code != 23007 {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err != errNoFeature {
 			result.Result = 2
 			result.Error = err.Error()
-			return
+			if code, ok := vendorStatus(result, err); ok {
+				return code, err.Error()
+			}
+			return http.StatusInternalServerError, err.Error()
 		}
 	}
 
 	// if featureId exists, checkin
-	if res != nil && res.featureId == featureId {
-		if res.score > *score { //  签到
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("yes, you are " + featureId))
+	if res != nil && res.FeatureId == featureId {
+		if res.Score > s.threshold { //  签到
 			result.Result = 1
-		} else {
-			http.Error(w, "no, you are not "+featureId, http.StatusBadRequest)
-			result.Error = "you are not " + featureId
-			result.Result = 2
+			return http.StatusOK, "yes, you are " + featureId
 		}
-		return
+		result.Error = "you are not " + featureId
+		result.Result = 2
+		return http.StatusBadRequest, "no, you are not " + featureId
 	}
 
 	// second, use searchFea(1:N) to find featureId
-	ri.apiName = "searchFea"
-	res, code, err = vrg(ri)
+	res, err = s.vp.Identify(ctx, buf)
 	if err != nil {
 		log.Println("Failed to search feature", err.Error())
-		if code != 23008 {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err != errNoFeature {
 			result.Result = 2
 			result.Error = err.Error()
-			return
+			if code, ok := vendorStatus(result, err); ok {
+				return code, err.Error()
+			}
+			return http.StatusInternalServerError, err.Error()
 		}
 	}
 
-	if res != nil && res.featureId == featureId {
+	if res != nil && res.FeatureId == featureId {
 		log.Println("can't go here, 1:1 not found, but 1:N found")
-		http.Error(w, "can't go here, 1:1 not found, but 1:N found", http.StatusInternalServerError)
 		result.Result = 2
 		result.Error = "server error"
-		return
+		return http.StatusInternalServerError, "can't go here, 1:1 not found, but 1:N found"
 	}
 
-	if res != nil && res.score >= *score {
-		http.Error(w, "oh, you are "+res.featureId+" not "+featureId, http.StatusBadRequest)
+	if res != nil && res.Score >= s.threshold {
 		result.Result = 2
-		result.Error = "you are " + res.featureId + " not " + featureId
-		return
+		result.Error = "you are " + res.FeatureId + " not " + featureId
+		return http.StatusBadRequest, "oh, you are " + res.FeatureId + " not " + featureId
 	}
 
-	ri.apiName = "createFeature"
-	ri.featureId = featureId
-	ri.featureInfo = featureInfo
-
-	_, _, err = vrg(ri)
-	if err != nil {
-		log.Println("create feature error: ", err.Error())
-		http.Error(w, "create feature error: "+err.Error(), http.StatusInternalServerError)
-		result.Result = 2
-		result.Error = err.Error()
-		return
-	}
-	w.Write([]byte("create new feature for you: " + featureId))
-	result.Result = 0
+	return s.enroll(ctx, j, enrollSample{jobId: j.jobId, audio: buf, snr: q.Snr})
 }
 
-func do_iat(audio_buf []byte, address, language string) (string, error) {
-	// save wav to file
-	t := time.Now().Unix()
-	fp := filepath.Join(*path, address+"_"+strconv.Itoa(int(t))+".wav")
-	err := os.WriteFile(fp, audio_buf, 0666)
-	if err != nil {
-		log.Println(err)
-		return "", err
+// vendorStatus returns the http status of a failed xfyun call if it is not a server error:
+// 429 or 503 with RetryAfter set if the call was not made because of the limits,
+// 503 if the xfyun quota is used up and 400 if xfyun rejected the audio.
+func vendorStatus(result *UploadResult, err error) (int, bool) {
+	code, retryAfter, ok := limitStatus(err)
+	switch {
+	case ok:
+		result.RetryAfter = retryAfter
+		return code, true
+	case errors.Is(err, errXfQuota):
+		return http.StatusServiceUnavailable, true
+	case errors.Is(err, errInvalidAudio):
+		return http.StatusBadRequest, true
 	}
-	fp_pcm := fp[:len(fp)-4] + ".pcm"
+	return 0, false
+}
 
-	// ffmpeg -y -i test.wav -acodec pcm_s16le -f s16le -ac 1 -ar 16000 test.pcm
-	cmd := fmt.Sprintf("ffmpeg -y -i %s -acodec pcm_s16le -f s16le -ac 1 -ar 16000 %s", fp, fp_pcm)
-	_, err = exec.Command("sh", "-c", cmd).Output()
+// decode archives the upload and decodes it to 16 kHz mono audio.
+func (s *server) decode(ctx context.Context, j *uploadJob) (*pcmAudio, error) {
+	format := sniffFormat(j.audio)
+	log.Println("upload format:", format, "size:", len(j.audio))
+	// 超时或者客户端断开也要留下录音
+	err := s.archive.save(context.WithoutCancel(ctx), j.address, j.jobId, j.created, "upload"+formatExt(format), j.audio)
 	if err != nil {
-		return "", err
-	}
-	if language == "" || language == "zh" {
-		language = "zh_cn"
-	} else {
-		language = "en_us"
+		log.Println("archive upload error:", err)
 	}
-
-	return iat(fp_pcm, language)
+	return decodeAudio(ctx, j.audio, format, s.audio)
 }
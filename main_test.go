@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the api of a server with the default config, changed by edit, against a mock xfyun.
+func newTestServer(t *testing.T, script mockScript, edit func(*Config)) *httptest.Server {
+	t.Helper()
+	conf := defaultConfig()
+	conf.Xfyun = testMockConfig(t, script)
+	conf.Xfyun.VrgEncoding = encodingRaw
+	conf.Audio.FFmpeg = ""
+	conf.Challenge.Phrases = []string{"芝麻开门"}
+	conf.Enroll.Samples = 1
+	conf.Replay.Enable = false
+	if edit != nil {
+		edit(conf)
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	lim := newLimits(conf.Limits)
+	s := newServer(conf, 0.36, serverDeps{
+		asr:   newXfRecognizer(conf.Xfyun, lim),
+		vp:    newXfVoiceprint(conf.Xfyun, "group_test", lim, http.DefaultClient),
+		store: newMemStore(conf.Store.History),
+		audio: newFSAudioStore(t.TempDir(), "", ""),
+	})
+	s.startJobs(conf.Jobs.Queue, conf.Jobs.Workers)
+	ts := httptest.NewServer(s.newMux(false))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+var testScript = mockScript{Transcripts: []string{"芝麻，开门。"}, DefaultScore: 0.9}
+
+// upload reads the challenge of address aloud and uploads it with query, it returns the status and the body.
+func upload(t *testing.T, ts *httptest.Server, address string, query url.Values) (int, string) {
+	t.Helper()
+	resp, err := http.Get(ts.URL + "/challenge?address=" + url.QueryEscape(address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ch challenge
+	err = json.NewDecoder(resp.Body).Decode(&ch)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("address", address)
+	query.Set("nonce", ch.Nonce)
+	wav := encodeWav(testSpeech(1).s16le(), speechRate)
+	resp, err = http.Post(ts.URL+"/upload?"+query.Encode(), "audio/wav", bytes.NewReader(wav))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func getResult(t *testing.T, ts *httptest.Server, address, id string) *UploadResult {
+	t.Helper()
+	resp, err := http.Get(ts.URL + "/upload/result?" + url.Values{"address": {address}, "id": {id}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r UploadResult
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	return &r
+}
+
+func TestUploadSync(t *testing.T) {
+	ts := newTestServer(t, testScript, nil)
+
+	// 空的声纹库：1:1 返回 23007，1:N 返回 23008，注册
+	code, msg := upload(t, ts, "0xabc", url.Values{"id": {"u1"}})
+	if code != http.StatusOK || !strings.Contains(msg, "create new feature") {
+		t.Fatalf("first upload: %d %s", code, msg)
+	}
+	if r := getResult(t, ts, "0xabc", "u1"); r.Result != 0 || r.Status != statusDone || r.Transcript != "芝麻，开门。" {
+		t.Errorf("first upload result: %+v", r)
+	}
+	code, msg = upload(t, ts, "0xabc", url.Values{"id": {"u2"}})
+	if code != http.StatusOK || msg != "yes, you are 0xabc" {
+		t.Fatalf("second upload: %d %s", code, msg)
+	}
+	if r := getResult(t, ts, "0xabc", ""); r.ID != "u2" || r.Result != 1 {
+		t.Errorf("latest result: %+v", r)
+	}
+
+	// 没有 nonce 的上传被拒绝
+	resp, err := http.Post(ts.URL+"/upload?address=0xabc&text=芝麻开门", "audio/wav", bytes.NewReader(encodeWav(testSpeech(1).s16le(), speechRate)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("upload without nonce: %d", resp.StatusCode)
+	}
+}
+
+func TestUploadAsync(t *testing.T) {
+	ts := newTestServer(t, testScript, func(c *Config) { c.Jobs.Async = true })
+	code, body := upload(t, ts, "0xabc", nil)
+	if code != http.StatusAccepted {
+		t.Fatalf("upload: %d %s", code, body)
+	}
+	var pending UploadResult
+	if err := json.Unmarshal([]byte(body), &pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending.ID == "" || pending.Status != statusPending {
+		t.Fatalf("pending result: %+v", pending)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		r := getResult(t, ts, "0xabc", pending.ID)
+		if r.Status == statusDone {
+			if r.Result != 0 || r.Job != pending.Job {
+				t.Errorf("done result: %+v", r)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s", r.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// 同步上传也可以
+	code, body = upload(t, ts, "0xabc", url.Values{"async": {"0"}})
+	if code != http.StatusOK || body != "yes, you are 0xabc" {
+		t.Errorf("sync upload: %d %s", code, body)
+	}
+}
+
+func TestUploadUnknownFeature(t *testing.T) {
+	tests := []struct {
+		name   string
+		script mockScript
+		code   int
+		msg    string
+		result int
+	}{
+		// 1:1 返回 23007，1:N 找到的别人分数不够，注册
+		{"enroll", mockScript{Transcripts: testScript.Transcripts, Features: []string{"0xdef"}, DefaultScore: 0.1}, http.StatusOK, "create new feature for you: 0xabc", 0},
+		// 1:N 找到了别人
+		{"someone else", mockScript{Transcripts: testScript.Transcripts, Features: []string{"0xdef"}, DefaultScore: 0.9}, http.StatusBadRequest, "oh, you are 0xdef not 0xabc", 2},
+		// 1:N 也返回 23007
+		{"group without features", mockScript{Transcripts: testScript.Transcripts, Errors: map[string]int{"searchFea": 23007}}, http.StatusOK, "create new feature for you: 0xabc", 0},
+		{"quota", mockScript{Transcripts: testScript.Transcripts, Errors: map[string]int{"searchFea": 11201}}, http.StatusServiceUnavailable, "mock error 11201", 2},
+		{"create error", mockScript{Transcripts: testScript.Transcripts, Errors: map[string]int{"createFeature": 10163}}, http.StatusInternalServerError, "create feature error", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, tt.script, nil)
+			code, msg := upload(t, ts, "0xabc", url.Values{"id": {"u1"}})
+			if code != tt.code || !strings.Contains(msg, tt.msg) {
+				t.Errorf("upload: %d %s, want %d %s", code, msg, tt.code, tt.msg)
+			}
+			if r := getResult(t, ts, "0xabc", "u1"); r.Result != tt.result {
+				t.Errorf("result: %+v", r)
+			}
+		})
+	}
+}
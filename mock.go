@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// mockScript describes how the mock xfyun server answers, e.g.
+//
+//	{
+//	  "transcripts": ["芝麻开门"],
+//	  "scores": {"0xabc": 0.9},
+//	  "default_score": 0.2,
+//	  "features": ["0xdef"],
+//	  "errors": {"createFeature": 10163}
+//	}
+type mockScript struct {
+	Transcripts  []string           `json:"transcripts"`   // iat 依次返回的识别结果，循环使用
+	Scores       map[string]float64 `json:"scores"`        // featureId 对应的比对分数
+	DefaultScore float64            `json:"default_score"` // 不在 scores 里的 featureId 的分数
+	Features     []string           `json:"features"`      // 启动时已注册的 featureId
+	Errors       map[string]int     `json:"errors"`        // "iat" 或 vrg 接口名对应要返回的错误码
+}
+
+// mockServer is a local fake of the iat websocket api and the s782b4996 voiceprint api,
+// so the upload flow can run without xfyun.
+type mockServer struct {
+	script mockScript
+
+	mu       sync.Mutex
+	n        int
+	features map[string]string // featureId -> featureInfo
+}
+
+func loadMockScript(fp string) (mockScript, error) {
+	var s mockScript
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
+
+// startMock serves the mock on a random local port, it returns the address.
+func startMock(script mockScript) (string, error) {
+	m := &mockServer{script: script, features: make(map[string]string)}
+	for _, id := range script.Features {
+		m.features[id] = id
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/iat", m.iatHandler)
+	mux.HandleFunc("/v1/private/s782b4996", m.vrgHandler)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		err := http.Serve(ln, mux)
+		log.Println("mock server stopped:", err)
+	}()
+	return ln.Addr().String(), nil
+}
+
+// useMock starts the mock server with the script at fp and points c to it.
+func useMock(c *Config, fp string) error {
+	script, err := loadMockScript(fp)
+	if err != nil {
+		return err
+	}
+	addr, err := startMock(script)
+	if err != nil {
+		return err
+	}
+	log.Println("using mock xfyun server at", addr)
+	c.Xfyun.IatUrl = "ws://" + addr + "/v2/iat"
+	c.Xfyun.VrgUrl = "http://" + addr + "/v1/private/s782b4996"
+	for _, p := range []*string{&c.Xfyun.AppId, &c.Xfyun.ApiKey, &c.Xfyun.ApiSecret} {
+		if *p == "" {
+			*p = "mock"
+		}
+	}
+	return nil
+}
+
+func (m *mockServer) nextTranscript() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.script.Transcripts) == 0 {
+		return ""
+	}
+	t := m.script.Transcripts[m.n%len(m.script.Transcripts)]
+	m.n++
+	return t
+}
+
+func (m *mockServer) iatHandler(w http.ResponseWriter, r *http.Request) {
+	up := websocket.Upgrader{}
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("mock iat upgrade error:", err)
+		return
+	}
+	defer conn.Close()
+
+	sid := "mock" + newJobId()
+	frames := 0
+	dwa := ""
+	for {
+		var frame struct {
+			Business struct {
+				Dwa string `json:"dwa"`
+			} `json:"business"`
+			Data struct {
+				Status int `json:"status"`
+			} `json:"data"`
+		}
+		err := conn.ReadJSON(&frame)
+		if err != nil {
+			log.Println("mock iat read error:", err)
+			return
+		}
+		if frame.Data.Status == STATUS_FIRST_FRAME {
+			dwa = frame.Business.Dwa
+		}
+		frames++
+		if frame.Data.Status == STATUS_LAST_FRAME {
+			break
+		}
+	}
+
+	if code, ok := m.script.Errors["iat"]; ok {
+		conn.WriteJSON(RespData{Sid: sid, Code: code, Message: "mock error " + strconv.Itoa(code)})
+		return
+	}
+
+	// 每个字作为一个词返回，最后一条消息 status = 2
+	// dwa=wpgs 时像真实接口一样逐字返回，每条替换之前的所有结果
+	text := []rune(m.nextTranscript())
+	ws := make([]Ws, len(text))
+	for i, c := range text {
+		ws[i] = Ws{Bg: i * 20, Cw: []Cw{{W: string(c)}}}
+	}
+	if dwa == "wpgs" {
+		for sn := 1; sn < len(text); sn++ {
+			res := Result{Sn: sn, Pgs: "apd", Ws: ws[:sn]}
+			if sn > 1 {
+				res.Pgs, res.Rg = "rpl", []int{1, sn - 1}
+			}
+			conn.WriteJSON(RespData{Sid: sid, Data: Data{Result: res, Status: 1}})
+		}
+	}
+	res := Result{Sn: max(len(text), 1), Ls: true, Ws: ws}
+	if dwa == "wpgs" && len(text) > 1 {
+		res.Pgs, res.Rg = "rpl", []int{1, len(text) - 1}
+	}
+	conn.WriteJSON(RespData{Sid: sid, Data: Data{Result: res, Status: 2}})
+	log.Println("mock iat:", frames, "frames, result:", string(text))
+}
+
+type mockVrgReq struct {
+	Header struct {
+		AppId string `json:"app_id"`
+	} `json:"header"`
+	Parameter struct {
+		S782b4996 struct {
+			Func         string `json:"func"`
+			GroupId      string `json:"groupId"`
+			FeatureId    string `json:"featureId"`
+			FeatureInfo  string `json:"featureInfo"`
+			DstFeatureId string `json:"dstFeatureId"`
+			TopK         int    `json:"topK"`
+		} `json:"s782b4996"`
+	} `json:"parameter"`
+}
+
+func (m *mockServer) score(featureId string) float64 {
+	if s, ok := m.script.Scores[featureId]; ok {
+		return s
+	}
+	return m.script.DefaultScore
+}
+
+func (m *mockServer) vrgHandler(w http.ResponseWriter, r *http.Request) {
+	var req mockVrgReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := req.Parameter.S782b4996
+	fn := p.Func
+	if fn == "" {
+		// genCreateFeatureReqBody 不带 func
+		fn = "createFeature"
+	}
+	reply := func(code int, message string, res interface{}) {
+		body := map[string]interface{}{
+			"header": map[string]interface{}{
+				"code":    code,
+				"message": message,
+				"sid":     "mock" + newJobId(),
+			},
+		}
+		if res != nil {
+			text, _ := json.Marshal(res)
+			body["payload"] = map[string]interface{}{
+				fn + "Res": map[string]interface{}{
+					"encoding": "utf8",
+					"compress": "raw",
+					"format":   "json",
+					"text":     base64.StdEncoding.EncodeToString(text),
+				},
+			}
+		}
+		json.NewEncoder(w).Encode(body)
+		log.Println("mock vrg:", fn, code, message)
+	}
+	if code, ok := m.script.Errors[fn]; ok {
+		reply(code, "mock error "+strconv.Itoa(code), nil)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch fn {
+	case "createFeature", "updateFeature":
+		m.features[p.FeatureId] = p.FeatureInfo
+		reply(0, "success", map[string]string{"featureId": p.FeatureId})
+	case "deleteFeature":
+		delete(m.features, p.FeatureId)
+		reply(0, "success", map[string]string{"msg": "success"})
+	case "searchScoreFea":
+		info, ok := m.features[p.DstFeatureId]
+		if !ok {
+			reply(23007, "feature not found: "+p.DstFeatureId, nil)
+			return
+		}
+		reply(0, "success", DearchScoreFeaResponse{Score: m.score(p.DstFeatureId), FeatureId: p.DstFeatureId, FeatureInfo: info})
+	case "searchFea":
+		if len(m.features) == 0 {
+			reply(23008, "group is empty", nil)
+			return
+		}
+		res := SearchFeaResponse{}
+		for id, info := range m.features {
+			res.ScoreList = append(res.ScoreList, DearchScoreFeaResponse{Score: m.score(id), FeatureId: id, FeatureInfo: info})
+		}
+		sort.Slice(res.ScoreList, func(i, j int) bool { return res.ScoreList[i].Score > res.ScoreList[j].Score })
+		if p.TopK > 0 && len(res.ScoreList) > p.TopK {
+			res.ScoreList = res.ScoreList[:p.TopK]
+		}
+		reply(0, "success", res)
+	case "queryFeatureList":
+		var list []map[string]string
+		for id, info := range m.features {
+			list = append(list, map[string]string{"featureId": id, "featureInfo": info})
+		}
+		reply(0, "success", list)
+	case "createGroup", "deleteGroup":
+		reply(0, "success", map[string]string{"groupId": p.GroupId})
+	default:
+		reply(10106, fmt.Sprintf("invalid func %q", fn), nil)
+	}
+}
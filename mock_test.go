@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// testMockConfig starts a mock server with script and returns the config pointing to it.
+func testMockConfig(t *testing.T, script mockScript) XfyunConfig {
+	t.Helper()
+	addr, err := startMock(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := defaultConfig().Xfyun
+	c.AppId, c.ApiKey, c.ApiSecret = "mock", "mock", "mock"
+	c.IatUrl = "ws://" + addr + "/v2/iat"
+	c.VrgUrl = "http://" + addr + "/v1/private/s782b4996"
+	return c
+}
+
+func TestMockIat(t *testing.T) {
+	asr := newXfRecognizer(testMockConfig(t, mockScript{Transcripts: []string{"芝麻开门", "你好"}}), nil)
+	opts, err := defaultConfig().Iat.options("zh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 识别结果依次返回
+	for _, want := range []string{"芝麻开门", "你好", "芝麻开门"} {
+		tr, err := asr.Recognize(context.Background(), make([]byte, 3*12800), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.String() != want || len(tr.Words) != len([]rune(want)) {
+			t.Fatalf("iat: %q %+v, want %q", tr.String(), tr.Words, want)
+		}
+	}
+}
+
+func TestMockVrg(t *testing.T) {
+	ctx := context.Background()
+	audio := []byte("mock")
+	vp := newXfVoiceprint(testMockConfig(t, mockScript{Scores: map[string]float64{"0xabc": 0.9}, DefaultScore: 0.1, Features: []string{"0xdef"}}), "group_test", nil, http.DefaultClient)
+	if _, err := vp.Verify(ctx, "0xabc", audio); err != errNoFeature {
+		t.Fatalf("verify a new feature: %v", err)
+	}
+	if res, err := vp.Identify(ctx, audio); err != nil || res.FeatureId != "0xdef" || res.Score != 0.1 {
+		t.Fatalf("identify: %+v %v", res, err)
+	}
+	if err := vp.Enroll(ctx, "0xabc", "0xabc", audio); err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if res, err := vp.Verify(ctx, "0xabc", audio); err != nil || res.FeatureId != "0xabc" || res.Score != 0.9 {
+		t.Fatalf("verify: %+v %v", res, err)
+	}
+
+	vp = newXfVoiceprint(testMockConfig(t, mockScript{Errors: map[string]int{"createFeature": 10163}}), "group_test", nil, http.DefaultClient)
+	if err := vp.Enroll(ctx, "0xabc", "0xabc", audio); err == nil {
+		t.Error("no error for a scripted error")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// QualityConfig holds the limits of the audio quality gate, a zero limit is not checked.
+type QualityConfig struct {
+	Enable      bool    `yaml:"enable"`
+	MinDuration float64 `yaml:"min_duration"` // seconds of speech
+	MaxDuration float64 `yaml:"max_duration"` // seconds of speech
+	MinRms      float64 `yaml:"min_rms"`      // dBFS
+	MaxClipping float64 `yaml:"max_clipping"` // ratio of clipped samples
+	MinSnr      float64 `yaml:"min_snr"`      // dB
+	// MinSampleRate is the lowest rate of the upload before resampling. Only wav and ogg vorbis
+	// decoded in process report their rate; audio decoded by ffmpeg is not checked.
+	MinSampleRate int `yaml:"min_sample_rate"`
+}
+
+// rejection reasons saved in UploadResult.Reason
+const (
+	reasonNoSpeech      = "no_speech"
+	reasonTooShort      = "too_short"
+	reasonTooLong       = "too_long"
+	reasonTooQuiet      = "too_quiet"
+	reasonClipped       = "clipped"
+	reasonNoisy         = "noisy"
+	reasonLowSampleRate = "low_sample_rate"
+	reasonReplay        = "replay"    // the recording was uploaded before, see ReplayConfig
+	reasonChallenge     = "challenge" // missing, unknown, expired or used nonce, see ChallengeConfig
+)
+
+// clipLevel is the level treated as clipped, a bit under full scale because of resampling.
+const clipLevel = 0.99
+
+// audioQuality is the measurement of one recording.
+type audioQuality struct {
+	Duration   float64 // seconds of speech
+	Peak       float64 // dBFS
+	Rms        float64 // dBFS
+	Clipping   float64 // ratio of clipped samples
+	Snr        float64 // dB, estimated from loud and quiet frames
+	SampleRate int     // Hz before resampling, 0 if unknown
+}
+
+// analyzeQuality measures mono audio a. speech is a with the silence trimmed and speechMs
+// the speech duration from vad, they are a and 0 if vad is off.
+func analyzeQuality(a, speech *pcmAudio, speechMs int) *audioQuality {
+	q := &audioQuality{Duration: speech.duration(), SampleRate: a.srcRate}
+	if speechMs > 0 {
+		q.Duration = float64(speechMs) / 1000
+	}
+	var peak, sum float64
+	clipped := 0
+	for _, v := range speech.samples {
+		x := math.Abs(float64(v))
+		peak = math.Max(peak, x)
+		sum += x * x
+		if x >= clipLevel {
+			clipped++
+		}
+	}
+	if n := len(speech.samples); n > 0 {
+		q.Rms = dbfs(math.Sqrt(sum / float64(n)))
+		q.Clipping = float64(clipped) / float64(n)
+	} else {
+		q.Rms = dbfs(0)
+	}
+	q.Peak = dbfs(peak)
+
+	// 噪声取最安静的 10% 帧，语音取最响的 10% 帧
+	frames := vadFrames(a, 20)
+	if len(frames) > 0 {
+		e := make([]float64, len(frames))
+		for i, f := range frames {
+			e[i] = f.energy
+		}
+		sort.Float64s(e)
+		q.Snr = e[len(e)*9/10] - e[len(e)/10]
+	}
+	return q
+}
+
+// check returns the first limit of c that q fails, as a reason and a message for the user.
+func (q *audioQuality) check(c QualityConfig) (string, string) {
+	switch {
+	case c.MinSampleRate > 0 && q.SampleRate > 0 && q.SampleRate < c.MinSampleRate:
+		return reasonLowSampleRate, fmt.Sprintf("sample rate %d Hz is lower than %d Hz", q.SampleRate, c.MinSampleRate)
+	case c.MinDuration > 0 && q.Duration < c.MinDuration:
+		return reasonTooShort, fmt.Sprintf("speech is too short: %.1fs < %.1fs", q.Duration, c.MinDuration)
+	case c.MaxDuration > 0 && q.Duration > c.MaxDuration:
+		return reasonTooLong, fmt.Sprintf("speech is too long: %.1fs > %.1fs", q.Duration, c.MaxDuration)
+	case c.MinRms != 0 && q.Rms < c.MinRms:
+		return reasonTooQuiet, fmt.Sprintf("audio is too quiet: %.1f dBFS < %.1f dBFS", q.Rms, c.MinRms)
+	case c.MaxClipping > 0 && q.Clipping > c.MaxClipping:
+		return reasonClipped, fmt.Sprintf("audio is clipped: %.2f%% of samples", q.Clipping*100)
+	case c.MinSnr > 0 && q.Snr < c.MinSnr:
+		return reasonNoisy, fmt.Sprintf("audio is too noisy: snr %.1f dB < %.1f dB", q.Snr, c.MinSnr)
+	}
+	return "", ""
+}
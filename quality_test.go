@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAnalyzeQuality(t *testing.T) {
+	c := defaultConfig()
+	a := testUtterance(1, 1, 0.3)
+	speech, ms := trimSilence(a, c.VAD)
+	q := analyzeQuality(a, speech, ms)
+	// 0.3 的正弦波：峰值 -10.5 dBFS，有效值 -13.5 dBFS；噪声 -60 dBFS
+	if q.Duration != float64(ms)/1000 || q.SampleRate != speechRate || q.Clipping != 0 {
+		t.Errorf("quality %+v", *q)
+	}
+	if math.Abs(q.Peak+10.5) > 0.2 || q.Rms > -13 || q.Rms < -16 || q.Snr < 40 {
+		t.Errorf("levels %+v", *q)
+	}
+	if reason, msg := q.check(c.Quality); reason != "" {
+		t.Errorf("good audio rejected: %s %s", reason, msg)
+	}
+
+	// 没有 vad 时用整段音频
+	if q := analyzeQuality(a, a, 0); q.Duration != a.duration() {
+		t.Errorf("duration without vad %v", q.Duration)
+	}
+
+	clipped := testUtterance(1, 1, 1.5)
+	for i, v := range clipped.samples {
+		clipped.samples[i] = max(min(v, 1), -1)
+	}
+	if q := analyzeQuality(clipped, clipped, 1000); q.Clipping < 0.1 || q.Peak != 0 {
+		t.Errorf("clipped audio %+v", *q)
+	}
+}
+
+func TestQualityCheck(t *testing.T) {
+	c := defaultConfig().Quality
+	good := audioQuality{Duration: 2, Peak: -3, Rms: -20, Clipping: 0, Snr: 30, SampleRate: 16000}
+	tests := []struct {
+		name   string
+		edit   func(q *audioQuality)
+		reason string
+	}{
+		{"good", func(q *audioQuality) {}, ""},
+		{"low rate", func(q *audioQuality) { q.SampleRate = 8000 }, reasonLowSampleRate},
+		// ffmpeg 解码的音频不知道原始采样率
+		{"unknown rate", func(q *audioQuality) { q.SampleRate = 0 }, ""},
+		{"short", func(q *audioQuality) { q.Duration = 0.5 }, reasonTooShort},
+		{"long", func(q *audioQuality) { q.Duration = 31 }, reasonTooLong},
+		{"quiet", func(q *audioQuality) { q.Rms = -45 }, reasonTooQuiet},
+		{"clipped", func(q *audioQuality) { q.Clipping = 0.05 }, reasonClipped},
+		{"noisy", func(q *audioQuality) { q.Snr = 5 }, reasonNoisy},
+		// 先报告采样率
+		{"low rate and noisy", func(q *audioQuality) { q.SampleRate, q.Snr = 8000, 5 }, reasonLowSampleRate},
+	}
+	for _, tt := range tests {
+		q := good
+		tt.edit(&q)
+		reason, msg := q.check(c)
+		if reason != tt.reason || (reason != "") != (msg != "") {
+			t.Errorf("%s: %q %q, want %q", tt.name, reason, msg, tt.reason)
+		}
+	}
+	// 为 0 的限制不检查
+	q := audioQuality{Duration: 0.1, Rms: -90, Clipping: 1, SampleRate: 8000}
+	if reason, _ := q.check(QualityConfig{Enable: true}); reason != "" {
+		t.Errorf("zero limits: %s", reason)
+	}
+}
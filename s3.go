@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config is an S3 compatible bucket (aws, minio, ceph ...), requests are signed with AWS signature v4.
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"` // e.g. https://s3.us-east-1.amazonaws.com or http://127.0.0.1:9000
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"` // 所有对象 key 的前缀
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	PathStyle bool   `yaml:"path_style"` // http://endpoint/bucket/key instead of http://bucket.endpoint/key, minio needs it
+}
+
+const (
+	amzDateFormat   = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// s3AudioStore is the S3 implementation of AudioStore.
+type s3AudioStore struct {
+	c      S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+func newS3AudioStore(c S3Config) *s3AudioStore {
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.Prefix != "" && !strings.HasSuffix(c.Prefix, "/") {
+		c.Prefix += "/"
+	}
+	return &s3AudioStore{c: c, client: &http.Client{Timeout: time.Minute}, now: time.Now}
+}
+
+// objectURL returns the url of key, or of the bucket if key is empty.
+func (s *s3AudioStore) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if s.c.PathStyle {
+		u.Path = "/" + s.c.Bucket + "/"
+	} else {
+		u.Host = s.c.Bucket + "." + u.Host
+		u.Path = "/"
+	}
+	if key != "" {
+		u.Path += s.c.Prefix + key
+	}
+	u.RawPath = awsEscape(u.Path, false)
+	return u, nil
+}
+
+// awsEscape is the uri encoding of signature v4, everything but A-Z a-z 0-9 - _ . ~ is escaped, and / if escapeSlash.
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !escapeSlash {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// signature computes the v4 signature of the canonical request.
+// headers are the signed headers with lower case names, host included.
+func (s *s3AudioStore) signature(t time.Time, method string, u *url.URL, q url.Values, headers map[string]string, payloadHash string) (signed, sig string) {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var ch strings.Builder
+	for _, k := range names {
+		ch.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signed = strings.Join(names, ";")
+	canonical := strings.Join([]string{method, u.EscapedPath(), canonicalQuery(q), ch.String(), signed, payloadHash}, "\n")
+
+	day := t.Format("20060102")
+	scope := day + "/" + s.c.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format(amzDateFormat) + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	key := hmacSha256([]byte("AWS4"+s.c.SecretKey), day)
+	key = hmacSha256(key, s.c.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	return signed, hex.EncodeToString(hmacSha256(key, toSign))
+}
+
+func (s *s3AudioStore) scope(t time.Time) string {
+	return s.c.AccessKey + "/" + t.Format("20060102") + "/" + s.c.Region + "/s3/aws4_request"
+}
+
+// s3Error is the xml error body of S3.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request and returns the body of a 2xx response.
+func (s *s3AudioStore) do(ctx context.Context, method, key string, q url.Values, body []byte) ([]byte, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = canonicalQuery(q)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	t := s.now().UTC()
+	payloadHash := sha256Hex(body)
+	headers := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           t.Format(amzDateFormat),
+	}
+	signed, sig := s.signature(t, method, u, q, headers, payloadHash)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", t.Format(amzDateFormat))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.scope(t)+", SignedHeaders="+signed+", Signature="+sig)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return b, nil
+	}
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet && key != "" {
+		return nil, errNoAudio
+	}
+	var e s3Error
+	xml.Unmarshal(b, &e)
+	return nil, fmt.Errorf("s3 %s %s: %s %s %s", method, key, resp.Status, e.Code, e.Message)
+}
+
+func (s *s3AudioStore) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.do(ctx, http.MethodPut, key, nil, data)
+	return err
+}
+
+func (s *s3AudioStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, key, nil, nil)
+}
+
+func (s *s3AudioStore) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, http.MethodDelete, key, nil, nil)
+	return err
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2.
+func (s *s3AudioStore) List(ctx context.Context, prefix string) ([]audioObject, error) {
+	var objs []audioObject
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.c.Prefix + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		b, err := s.do(ctx, http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var r listBucketResult
+		err = xml.Unmarshal(b, &r)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range r.Contents {
+			objs = append(objs, audioObject{Key: strings.TrimPrefix(c.Key, s.c.Prefix), Size: c.Size, ModTime: c.LastModified})
+		}
+		if !r.IsTruncated || r.NextContinuationToken == "" {
+			return objs, nil
+		}
+		token = r.NextContinuationToken
+	}
+}
+
+// SignedURL returns a presigned GET url, S3 limits ttl to 7 days.
+func (s *s3AudioStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+	t := s.now().UTC()
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.scope(t)},
+		"X-Amz-Date":          {t.Format(amzDateFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	_, sig := s.signature(t, http.MethodGet, u, q, map[string]string{"host": u.Host}, unsignedPayload)
+	q.Set("X-Amz-Signature", sig)
+	u.RawQuery = canonicalQuery(q)
+	return u.String(), nil
+}
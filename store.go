@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var errNoResult = errors.New("no result")
+
+// ResultStore keeps a bounded history of upload results per address.
+// Implementations must be safe for concurrent use.
+type ResultStore interface {
+	// Put adds r to the history of address. A result with the same non-empty ID replaces the old one.
+	Put(address string, r *UploadResult) error
+	// Latest returns the last result of address, or errNoResult.
+	Latest(address string) (*UploadResult, error)
+	// Get returns the result of address with upload id, or errNoResult.
+	Get(address, id string) (*UploadResult, error)
+	// Evict removes results created before t.
+	Evict(t time.Time) error
+	Close() error
+}
+
+func newResultStore(c StoreConfig) (ResultStore, error) {
+	switch c.Type {
+	case "memory":
+		return newMemStore(c.History), nil
+	case "bolt":
+		return newBoltStore(c.Path, c.History)
+	}
+	return nil, fmt.Errorf("unknown store type: %s", c.Type)
+}
+
+// evictLoop drops results older than ttl every interval.
+func evictLoop(s ResultStore, ttl, interval time.Duration) {
+	if ttl <= 0 || interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		err := s.Evict(time.Now().Add(-ttl))
+		if err != nil {
+			log.Println("evict results error:", err)
+		}
+	}
+}
+
+// history is the result list of one address, oldest first.
+type history []*UploadResult
+
+func (h history) add(r *UploadResult, max int) history {
+	if r.ID != "" {
+		for i, v := range h {
+			if v.ID == r.ID {
+				h[i] = r
+				return h
+			}
+		}
+	}
+	h = append(h, r)
+	if max > 0 && len(h) > max {
+		h = h[len(h)-max:]
+	}
+	return h
+}
+
+func (h history) latest() *UploadResult {
+	if len(h) == 0 {
+		return nil
+	}
+	return h[len(h)-1]
+}
+
+func (h history) get(id string) *UploadResult {
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i].ID == id {
+			return h[i]
+		}
+	}
+	return nil
+}
+
+func (h history) expire(t time.Time) history {
+	before := int(t.Unix())
+	var n history
+	for _, v := range h {
+		if v.Timestamp >= before {
+			n = append(n, v)
+		}
+	}
+	return n
+}
+
+// memStore is the in-process store, results are lost on restart.
+type memStore struct {
+	max int
+	mu  sync.Mutex
+	m   map[string]history
+}
+
+func newMemStore(max int) *memStore {
+	return &memStore{max: max, m: make(map[string]history)}
+}
+
+func (s *memStore) Put(address string, r *UploadResult) error {
+	cp := *r
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[address] = s.m[address].add(&cp, s.max)
+	return nil
+}
+
+func (s *memStore) Latest(address string) (*UploadResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyResult(s.m[address].latest())
+}
+
+func (s *memStore) Get(address, id string) (*UploadResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyResult(s.m[address].get(id))
+}
+
+func (s *memStore) Evict(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, h := range s.m {
+		h = h.expire(t)
+		if len(h) == 0 {
+			delete(s.m, k)
+		} else {
+			s.m[k] = h
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+func copyResult(r *UploadResult) (*UploadResult, error) {
+	if r == nil {
+		return nil, errNoResult
+	}
+	cp := *r
+	return &cp, nil
+}
+
+var resultBucket = []byte("results")
+
+// boltStore saves the history of each address as json in a bbolt file, key is the address.
+type boltStore struct {
+	max int
+	db  *bolt.DB
+}
+
+func newBoltStore(fp string, max int) (*boltStore, error) {
+	db, err := bolt.Open(fp, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(resultBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{max: max, db: db}, nil
+}
+
+func readHistory(b *bolt.Bucket, address string) (history, error) {
+	data := b.Get([]byte(address))
+	if data == nil {
+		return nil, nil
+	}
+	var h history
+	err := json.Unmarshal(data, &h)
+	if err != nil {
+		// 兼容旧版本只保存一条结果的格式
+		r := &UploadResult{}
+		if json.Unmarshal(data, r) == nil {
+			return history{r}, nil
+		}
+		return nil, err
+	}
+	return h, nil
+}
+
+func writeHistory(b *bolt.Bucket, address string, h history) error {
+	if len(h) == 0 {
+		return b.Delete([]byte(address))
+	}
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(address), data)
+}
+
+func (s *boltStore) Put(address string, r *UploadResult) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(resultBucket)
+		h, err := readHistory(b, address)
+		if err != nil {
+			return err
+		}
+		return writeHistory(b, address, h.add(r, s.max))
+	})
+}
+
+func (s *boltStore) view(address string, f func(history) *UploadResult) (*UploadResult, error) {
+	var r *UploadResult
+	err := s.db.View(func(tx *bolt.Tx) error {
+		h, err := readHistory(tx.Bucket(resultBucket), address)
+		if err != nil {
+			return err
+		}
+		r = f(h)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, errNoResult
+	}
+	return r, nil
+}
+
+func (s *boltStore) Latest(address string) (*UploadResult, error) {
+	return s.view(address, history.latest)
+}
+
+func (s *boltStore) Get(address, id string) (*UploadResult, error) {
+	return s.view(address, func(h history) *UploadResult {
+		return h.get(id)
+	})
+}
+
+func (s *boltStore) Evict(t time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(resultBucket)
+		var keys []string
+		err := b.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			h, err := readHistory(b, k)
+			if err != nil {
+				return err
+			}
+			n := h.expire(t)
+			if len(n) == len(h) {
+				continue
+			}
+			err = writeHistory(b, k, n)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
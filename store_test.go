@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func testStores(t *testing.T, max int) map[string]ResultStore {
+	bs, err := newBoltStore(filepath.Join(t.TempDir(), "vps.db"), max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bs.Close() })
+	return map[string]ResultStore{"memory": newMemStore(max), "bolt": bs}
+}
+
+func TestResultStore(t *testing.T) {
+	now := int(time.Now().Unix())
+	for name, s := range testStores(t, 3) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.Latest("0xabc"); err != errNoResult {
+				t.Fatalf("empty store: %v", err)
+			}
+			for _, id := range []string{"u1", "u2", "", "u3"} {
+				s.Put("0xabc", &UploadResult{ID: id, Status: statusPending, Timestamp: now})
+			}
+			s.Put("0xdef", &UploadResult{ID: "u1", Timestamp: now})
+			// 同一个 ID 替换原来的结果，不占位置
+			s.Put("0xabc", &UploadResult{ID: "u3", Status: statusDone, Result: 1, Timestamp: now})
+
+			tests := []struct {
+				id     string
+				want   *UploadResult
+				status string
+			}{
+				{"u1", nil, ""}, // 超过 History 被丢掉
+				{"u2", &UploadResult{ID: "u2"}, statusPending},
+				{"u3", &UploadResult{ID: "u3"}, statusDone},
+				{"u4", nil, ""},
+			}
+			for _, tt := range tests {
+				r, err := s.Get("0xabc", tt.id)
+				if tt.want == nil {
+					if err != errNoResult {
+						t.Errorf("get %s: %+v %v", tt.id, r, err)
+					}
+					continue
+				}
+				if err != nil || r.ID != tt.want.ID || r.Status != tt.status {
+					t.Errorf("get %s: %+v %v", tt.id, r, err)
+				}
+			}
+			if r, err := s.Latest("0xabc"); err != nil || r.ID != "u3" || r.Result != 1 {
+				t.Errorf("latest: %+v %v", r, err)
+			}
+			// 返回的是副本
+			r, _ := s.Latest("0xabc")
+			r.Result = 2
+			if r, _ := s.Latest("0xabc"); r.Result != 1 {
+				t.Error("changing a returned result changed the store")
+			}
+
+			s.Put("0xabc", &UploadResult{ID: "old", Timestamp: now - 100})
+			if err := s.Evict(time.Unix(int64(now-10), 0)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get("0xabc", "old"); err != errNoResult {
+				t.Errorf("expired result: %v", err)
+			}
+			if r, err := s.Get("0xabc", "u3"); err != nil || r.ID != "u3" {
+				t.Errorf("result after evict: %+v %v", r, err)
+			}
+			if err := s.Evict(time.Unix(int64(now+10), 0)); err != nil {
+				t.Fatal(err)
+			}
+			for _, address := range []string{"0xabc", "0xdef"} {
+				if _, err := s.Latest(address); err != errNoResult {
+					t.Errorf("%s after evicting all: %v", address, err)
+				}
+			}
+		})
+	}
+}
+
+func TestBoltStoreLegacy(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "vps.db")
+	s, err := newBoltStore(fp, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// 旧版本每个地址只保存一条结果
+	legacy, _ := json.Marshal(UploadResult{ID: "u1", Result: 1, Timestamp: int(time.Now().Unix())})
+	s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(resultBucket).Put([]byte("0xabc"), legacy)
+	})
+	if r, err := s.Latest("0xabc"); err != nil || r.ID != "u1" || r.Result != 1 {
+		t.Fatalf("legacy result: %+v %v", r, err)
+	}
+	if err := s.Put("0xabc", &UploadResult{ID: "u2"}); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := s.Get("0xabc", "u1"); err != nil || r.Result != 1 {
+		t.Errorf("legacy result after put: %+v %v", r, err)
+	}
+	if r, err := s.Latest("0xabc"); err != nil || r.ID != "u2" {
+		t.Errorf("latest after put: %+v %v", r, err)
+	}
+}
+
+func TestEvictLoop(t *testing.T) {
+	s := newMemStore(3)
+	s.Put("0xabc", &UploadResult{ID: "u1", Timestamp: int(time.Now().Add(-2 * time.Hour).Unix())})
+	// ttl 为 0 时不清理，直接返回
+	evictLoop(s, 0, time.Millisecond)
+	if _, err := s.Latest("0xabc"); err != nil {
+		t.Fatalf("result without ttl: %v", err)
+	}
+	go evictLoop(s, time.Hour, 10*time.Millisecond)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := s.Latest("0xabc"); err == errNoResult {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired result is not evicted")
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamMaxBytes bounds the audio of one /stream session, 60 s of 16 kHz s16le.
+const streamMaxBytes = 60 * speechRate * 2
+
+// streamIdleTimeout is how long the client may send nothing before the session fails.
+var streamIdleTimeout = 10 * time.Second
+
+var (
+	errStreamTooLong = errors.New("stream is longer than 60s")
+	errOddFrame      = errors.New("audio frame is not 16 bits pcm")
+)
+
+// streamMessage is sent to the /stream client: Partial while recognizing,
+// then Result and Message of the verification, like /upload/result and the /upload response.
+type streamMessage struct {
+	Partial string        `json:",omitempty"`
+	Result  *UploadResult `json:",omitempty"`
+	Message string        `json:",omitempty"`
+}
+
+var streamUpgrader = websocket.Upgrader{
+	// 与 /upload 的 CORS 一致，允许任意来源
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// streamHandler is /upload over a websocket, so the transcript is shown while the user speaks.
+// The query is the same as /upload. The client sends 16 kHz mono s16le pcm as binary messages while recording
+// and a text message "end" when done; the audio goes to iat as it arrives and the partial transcripts come back.
+// Then the recording is verified like an upload and the connection is closed after the final message.
+func (s *server) streamHandler(w http.ResponseWriter, r *http.Request) {
+	sr, ok := s.asr.(StreamRecognizer)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusNotImplemented)
+		return
+	}
+	job := s.newUploadJob(w, r)
+	if job == nil {
+		return
+	}
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("stream upgrade error:", err)
+		s.restoreChallenge(job)
+		return
+	}
+	defer conn.Close()
+	// 一条消息也不能超过整个会话的上限
+	conn.SetReadLimit(streamMaxBytes)
+	log.Println("stream job:", job.jobId, "id:", job.result.ID, "address:", job.address, "featureId:", job.featureId, "language:", job.language, "text:", job.text)
+
+	ctx := r.Context()
+	msg := "iat error"
+	closeCode := websocket.CloseNormalClosure
+	pcm, transcript, err := s.recognizeStream(ctx, conn, sr, job.iatOptions)
+	if err != nil {
+		log.Println("stream error:", err)
+		job.result.Result = 2
+		job.result.Error = "iat error " + err.Error()
+		vendorStatus(job.result, err)
+		if job.result.RetryAfter > 0 {
+			closeCode = websocket.CloseTryAgainLater
+		}
+		s.finish(context.WithoutCancel(ctx), job)
+	} else {
+		job.audio = encodeWav(pcm, speechRate)
+		job.transcript = transcript
+		_, msg = s.run(ctx, job)
+	}
+	conn.WriteJSON(streamMessage{Result: job.result, Message: msg})
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, ""), time.Now().Add(time.Second))
+}
+
+// recognizeStream forwards the audio of the client to a recognition session and sends the partial transcripts back.
+// It returns the audio received until the final transcript and the transcript.
+func (s *server) recognizeStream(ctx context.Context, conn *websocket.Conn, sr StreamRecognizer, opts IatOptions) ([]byte, *Transcript, error) {
+	st, err := sr.RecognizeStream(ctx, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer st.Close()
+
+	rd := &streamReader{conn: conn}
+	done := make(chan error, 1)
+	go func() {
+		err := forwardAudio(rd, st)
+		done <- err
+		if err != nil {
+			// 让 Recv 返回
+			st.Close()
+		}
+	}()
+
+	for {
+		t, final, err := st.Recv()
+		if err == nil && !final {
+			conn.WriteJSON(streamMessage{Partial: t.String()})
+			continue
+		}
+		if err != nil {
+			// 客户端的错误更能说明原因，它在关闭 st 之前已经放进 done
+			select {
+			case ferr := <-done:
+				if ferr != nil {
+					return nil, nil, ferr
+				}
+			default:
+			}
+			return nil, nil, err
+		}
+		// iat 可能因为静音在客户端结束前先结束，不再等客户端；
+		// 读客户端的 goroutine 在 streamHandler 关闭连接时退出
+		return rd.audio(), t, nil
+	}
+}
+
+// streamReader reads the messages of the client, each within streamIdleTimeout, and keeps the audio.
+// Only forwardAudio reads the connection, the reads end when the connection is closed.
+type streamReader struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+	pcm  []byte
+}
+
+func (r *streamReader) read() (int, []byte, error) {
+	r.conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+	return r.conn.ReadMessage()
+}
+
+// audio returns the audio received so far.
+func (r *streamReader) audio() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pcm
+}
+
+// forwardAudio sends the binary messages of rd to st and keeps them in rd until a text message ends the audio.
+func forwardAudio(rd *streamReader, st RecognizeStream) error {
+	for {
+		mt, b, err := rd.read()
+		if err != nil {
+			return err
+		}
+		if mt == websocket.TextMessage {
+			return st.CloseSend()
+		}
+		if len(b)%2 != 0 {
+			return errOddFrame
+		}
+		rd.mu.Lock()
+		if len(rd.pcm)+len(b) > streamMaxBytes {
+			rd.mu.Unlock()
+			return errStreamTooLong
+		}
+		rd.pcm = append(rd.pcm, b...)
+		rd.mu.Unlock()
+		err = st.Send(b)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialStream(t *testing.T, ts *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/stream?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// finalMessage reads the messages of the server until the one with the result.
+func finalMessage(t *testing.T, conn *websocket.Conn) (streamMessage, int) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var partials int
+	for {
+		var m streamMessage
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("after %d partial transcripts: %v", partials, err)
+		}
+		if m.Result != nil {
+			return m, partials
+		}
+		partials++
+	}
+}
+
+func TestStream(t *testing.T) {
+	ts := newTestServer(t, testScript, func(c *Config) { c.Challenge.Require = false })
+	conn := dialStream(t, ts, "address=0xabc&text=芝麻开门")
+	pcm := testSpeech(1).s16le()
+	for i := 0; i < len(pcm); i += 6400 {
+		if err := conn.WriteMessage(websocket.BinaryMessage, pcm[i:min(i+6400, len(pcm))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("end"))
+	m, partials := finalMessage(t, conn)
+	if m.Result.Result != 0 || m.Result.Transcript != "芝麻，开门。" || partials == 0 {
+		t.Errorf("result %+v after %d partial transcripts", m.Result, partials)
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	ts := newTestServer(t, testScript, func(c *Config) { c.Challenge.Require = false })
+
+	// 一条消息超过整个会话的上限
+	conn := dialStream(t, ts, "address=0xabc&text=芝麻开门")
+	conn.WriteMessage(websocket.BinaryMessage, make([]byte, streamMaxBytes+2))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	// 服务端可能在客户端写完之前就关闭了连接，只能从结果判断
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("oversized message is read")
+	}
+	// 关闭帧可能在结果保存之前到达
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		r := getResult(t, ts, "0xabc", "")
+		if r.Status == statusDone {
+			if r.Result != 2 {
+				t.Errorf("oversized message result: %+v", r)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("oversized message result still %s", r.Status)
+		}
+	}
+
+	defer func(d time.Duration) { streamIdleTimeout = d }(streamIdleTimeout)
+	streamIdleTimeout = 200 * time.Millisecond
+	conn = dialStream(t, ts, "address=0xabc&text=芝麻开门")
+	conn.WriteMessage(websocket.BinaryMessage, make([]byte, 3200))
+	st := time.Now()
+	m, _ := finalMessage(t, conn)
+	if m.Result.Result != 2 || !strings.Contains(m.Result.Error, "timeout") {
+		t.Errorf("idle client: %+v", m.Result)
+	}
+	if d := time.Since(st); d > 5*time.Second {
+		t.Errorf("idle client failed after %v", d)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+func httpsServer(c TLSConfig, h http.Handler) {
+	cr, err := newCertReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		log.Fatal("load certificate: ", err)
+	}
+	go cr.watch(c.ReloadInterval)
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+	}
+	if c.ClientCAFile != "" {
+		pool, err := loadCertPool(c.ClientCAFile)
+		if err != nil {
+			log.Fatal("load client ca: ", err)
+		}
+		cfg.ClientCAs = pool
+		// 只有 /upload 需要客户端证书，其他接口照常访问
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	server := &http.Server{
+		Addr:      c.Addr,
+		Handler:   h,
+		TLSConfig: cfg,
+	}
+
+	fmt.Println("Starting HTTPS server...")
+	err = server.ListenAndServeTLS("", "")
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println("HTTPS server stopped.")
+}
+
+func loadCertPool(fp string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificate found in " + fp)
+	}
+	return pool, nil
+}
+
+// requireClientCert rejects requests without a verified client certificate.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			log.Println("reject request without client certificate from", r.RemoteAddr)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certReloader serves the certificate from certFile/keyFile and reloads it when the files change.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var t time.Time
+	for _, fp := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(fp)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func (cr *certReloader) reload() error {
+	mt, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = mt
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *certReloader) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		mt, err := cr.lastModified()
+		if err != nil {
+			log.Println("stat certificate:", err)
+			continue
+		}
+		cr.mu.RLock()
+		changed := !mt.Equal(cr.modTime)
+		cr.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		// 证书和私钥可能不是同时写入的，加载失败时保留旧证书，下次再试
+		err = cr.reload()
+		if err != nil {
+			log.Println("reload certificate:", err)
+			continue
+		}
+		log.Println("certificate reloaded:", cr.certFile)
+	}
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
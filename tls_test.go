@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate signed by parent (self signed if parent is nil) and its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves the certificate and the key as pem files in dir.
+func (c *testCert) write(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestCert(t, "a", nil, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := a.write(t, dir)
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := func() []byte {
+		c, _ := cr.getCertificate(nil)
+		return c.Certificate[0]
+	}
+	if !bytes.Equal(current(), a.der) {
+		t.Fatal("initial certificate is not loaded")
+	}
+	go cr.watch(10 * time.Millisecond)
+
+	// 只写了一半的证书不会替换旧证书
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(certFile, []byte("-----BEGIN CERTIFICATE-----\n"), 0600)
+	os.Chtimes(certFile, later, later)
+	time.Sleep(50 * time.Millisecond)
+	if !bytes.Equal(current(), a.der) {
+		t.Fatal("certificate replaced by a broken file")
+	}
+
+	b := newTestCert(t, "b", nil, x509.ExtKeyUsageServerAuth)
+	b.write(t, dir)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	for deadline := time.Now().Add(5 * time.Second); !bytes.Equal(current(), b.der); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("new certificate is not loaded")
+		}
+	}
+
+	if _, err := newCertReloader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("no error for a missing certificate")
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, x509.ExtKeyUsageAny)
+	serverCert := newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth)
+	device := newTestCert(t, "device", ca, x509.ExtKeyUsageClientAuth)
+	stranger := newTestCert(t, "stranger", newTestCert(t, "other ca", nil, x509.ExtKeyUsageAny), x509.ExtKeyUsageClientAuth)
+
+	s := newServer(defaultConfig(), 0.36, serverDeps{store: newMemStore(10), audio: newFSAudioStore(t.TempDir(), "", "")})
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ts := httptest.NewUnstartedServer(s.newMux(true))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tls()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := func(c *testCert) *http.Client {
+		cfg := &tls.Config{RootCAs: pool}
+		if c != nil {
+			cfg.Certificates = []tls.Certificate{c.tls()}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	}
+	tests := []struct {
+		name   string
+		client *http.Client
+		method string
+		path   string
+		code   int
+	}{
+		{"upload without certificate", client(nil), http.MethodPost, "/upload?address=0xabc", http.StatusUnauthorized},
+		{"challenge without certificate", client(nil), http.MethodGet, "/challenge?address=0xabc", http.StatusUnauthorized},
+		{"stream without certificate", client(nil), http.MethodGet, "/stream?address=0xabc", http.StatusUnauthorized},
+		// 结果查询不需要证书
+		{"result without certificate", client(nil), http.MethodGet, "/upload/result?address=0xabc", http.StatusOK},
+		{"challenge with certificate", client(device), http.MethodGet, "/challenge?address=0xabc", http.StatusOK},
+		// 不是 client_ca_file 签发的证书不会被发送或者通过验证
+		{"challenge with certificate of another ca", client(stranger), http.MethodGet, "/challenge?address=0xabc", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+		resp, err := tt.client.Do(req)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: %d, want %d", tt.name, resp.StatusCode, tt.code)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// IatConfig controls the iat sessions and how the transcript is checked against the expected phrase.
+// The language parameter of an upload is looked up in Languages, then in iatLanguages,
+// and the session uses the options of the group of that language, Chinese (zh_cn) or Other.
+type IatConfig struct {
+	// MinConfidence is the lowest Cw.Sc accepted for the words of the phrase, 0 disables the check.
+	// Only useful if iat reports sc for the app, otherwise every word has 0.
+	MinConfidence float64 `yaml:"min_confidence"`
+
+	Chinese   IatOptions             `yaml:"chinese"`   // language 和 accent 不生效
+	Other     IatOptions             `yaml:"other"`     // language 和 accent 不生效
+	Languages map[string]IatLanguage `yaml:"languages"` // 添加或覆盖内置的语言
+	// StrictLanguage rejects an unknown language parameter with 400 instead of recognizing it as en.
+	StrictLanguage bool `yaml:"strict_language"`
+}
+
+// Word is one word of a transcript.
+type Word struct {
+	Text       string
+	Confidence float64 // Cw.Sc of the best candidate
+	OffsetMs   int     // Ws.Bg, start of the word in the audio
+}
+
+// Transcript is the iat result word by word.
+type Transcript struct {
+	Words []Word
+}
+
+func (t *Transcript) String() string {
+	var b strings.Builder
+	for _, w := range t.Words {
+		b.WriteString(w.Text)
+	}
+	return b.String()
+}
+
+// match finds phrase in t the way normalizeTranscript compares them and returns the words it spans.
+// An empty phrase always matches, spanning no words.
+func (t *Transcript) match(phrase string) ([]Word, bool) {
+	want := []rune(normalizeTranscript(phrase))
+	if len(want) == 0 {
+		return nil, true
+	}
+	// 规范化后的每个字对应的词
+	var heard []rune
+	var owner []int
+	for i, w := range t.Words {
+		for _, r := range normalizeTranscript(w.Text) {
+			heard = append(heard, r)
+			owner = append(owner, i)
+		}
+	}
+	for p := 0; p+len(want) <= len(heard); p++ {
+		if string(heard[p:p+len(want)]) == string(want) {
+			return t.Words[owner[p] : owner[p+len(want)-1]+1], true
+		}
+	}
+	return nil, false
+}
+
+// unclear returns the first word with a confidence under min, nil if there is none.
+func unclear(words []Word, min float64) *Word {
+	for i := range words {
+		// 标点没有置信度
+		if words[i].Confidence < min && strings.IndexFunc(words[i].Text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0 {
+			return &words[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// VADConfig controls the voice activity detection in front of iat and the voiceprint api.
+// A frame is speech if its energy is Threshold dB above the noise floor (and above MinEnergy dBFS),
+// or a bit quieter but with a high zero crossing rate, which catches fricatives like s/sh/f.
+type VADConfig struct {
+	Enable    bool    `yaml:"enable"`
+	FrameMs   int     `yaml:"frame_ms"`
+	Threshold float64 `yaml:"threshold"`  // dB above noise floor
+	MinEnergy float64 `yaml:"min_energy"` // dBFS
+	PaddingMs int     `yaml:"padding_ms"` // 保留语音前后的静音长度
+}
+
+// vadFrame is the energy (dBFS) and zero crossing rate of one frame.
+type vadFrame struct {
+	energy float64
+	zcr    float64
+}
+
+func vadFrames(a *pcmAudio, frameMs int) []vadFrame {
+	size := a.rate * frameMs / 1000
+	if size <= 0 {
+		return nil
+	}
+	var frames []vadFrame
+	for p := 0; p+size <= len(a.samples); p += size {
+		var sum float64
+		zc := 0
+		for i := p; i < p+size; i++ {
+			v := float64(a.samples[i])
+			sum += v * v
+			if i > p && (a.samples[i-1] < 0) != (a.samples[i] < 0) {
+				zc++
+			}
+		}
+		frames = append(frames, vadFrame{
+			energy: dbfs(math.Sqrt(sum / float64(size))),
+			zcr:    float64(zc) / float64(size),
+		})
+	}
+	return frames
+}
+
+// dbfs converts a linear level in [0, 1] to dBFS, silence is -100.
+func dbfs(v float64) float64 {
+	if v < 1e-5 {
+		return -100
+	}
+	return 20 * math.Log10(v)
+}
+
+// noiseFloor estimates the background level as the 10th percentile of frame energy.
+func noiseFloor(frames []vadFrame) float64 {
+	if len(frames) == 0 {
+		return -100
+	}
+	e := make([]float64, len(frames))
+	for i, f := range frames {
+		e[i] = f.energy
+	}
+	sort.Float64s(e)
+	return e[len(e)/10]
+}
+
+// detectSpeech marks the speech frames of a.
+func detectSpeech(a *pcmAudio, c VADConfig) []bool {
+	frames := vadFrames(a, c.FrameMs)
+	floor := noiseFloor(frames)
+	loud := math.Max(floor+c.Threshold, c.MinEnergy)
+	quiet := math.Max(floor+c.Threshold/2, c.MinEnergy)
+	speech := make([]bool, len(frames))
+	for i, f := range frames {
+		speech[i] = f.energy > loud || (f.energy > quiet && f.zcr > 0.25)
+	}
+	// 去掉孤立的单帧，一般是咔哒声
+	for i := range speech {
+		if speech[i] && (i == 0 || !speech[i-1]) && (i == len(speech)-1 || !speech[i+1]) {
+			speech[i] = false
+		}
+	}
+	return speech
+}
+
+// trimSilence cuts the leading and trailing silence of mono audio a, keeping PaddingMs around the speech.
+// It returns the trimmed audio and the speech duration in milliseconds, which is 0 if no speech is found.
+func trimSilence(a *pcmAudio, c VADConfig) (*pcmAudio, int) {
+	speech := detectSpeech(a, c)
+	first, last, n := -1, -1, 0
+	for i, s := range speech {
+		if !s {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		n++
+	}
+	if n == 0 {
+		return a, 0
+	}
+	size := a.rate * c.FrameMs / 1000
+	pad := a.rate * c.PaddingMs / 1000
+	start := max(first*size-pad, 0)
+	end := min((last+1)*size+pad, len(a.samples))
+	return &pcmAudio{rate: a.rate, channels: 1, samples: a.samples[start:end], srcRate: a.srcRate}, n * c.FrameMs
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// testUtterance is silence (with a little noise), tone seconds of a 300 Hz tone at level and silence again.
+func testUtterance(silence, tone, level float64) *pcmAudio {
+	r := rand.New(rand.NewSource(1))
+	n0, n1 := int(silence*speechRate), int(tone*speechRate)
+	a := &pcmAudio{rate: speechRate, channels: 1, samples: make([]float32, 2*n0+n1), srcRate: speechRate}
+	for i := range a.samples {
+		v := 0.001 * r.NormFloat64()
+		if i >= n0 && i < n0+n1 {
+			v += level * math.Sin(2*math.Pi*300*float64(i)/speechRate)
+		}
+		a.samples[i] = float32(v)
+	}
+	return a
+}
+
+func TestTrimSilence(t *testing.T) {
+	c := defaultConfig().VAD
+	a := testUtterance(1, 1, 0.3)
+	speech, ms := trimSilence(a, c)
+	if ms < 960 || ms > 1040 {
+		t.Errorf("speech %d ms, want 1000", ms)
+	}
+	// 前后各留 PaddingMs
+	if d := speech.duration(); math.Abs(d-1.4) > 0.05 {
+		t.Errorf("trimmed to %.3f s, want 1.4", d)
+	}
+	if speech.rate != a.rate || speech.srcRate != a.srcRate {
+		t.Errorf("trimmed rate %d src %d", speech.rate, speech.srcRate)
+	}
+
+	silence := testUtterance(1, 0, 0)
+	if b, ms := trimSilence(silence, c); ms != 0 || b != silence {
+		t.Errorf("silence: %d ms", ms)
+	}
+}
+
+func TestDetectSpeech(t *testing.T) {
+	c := defaultConfig().VAD
+	frame := speechRate * c.FrameMs / 1000
+	a := testUtterance(1, 0, 0)
+	set := func(from int, f func(i int) float64) {
+		for i := from; i < from+frame*5; i++ {
+			a.samples[i] = float32(f(i))
+		}
+	}
+	r := rand.New(rand.NewSource(2))
+	// 单帧的咔哒声不算语音
+	a.samples[frame*10+frame/2] = 0.9
+	// 轻的摩擦音：能量不够高，但过零率高
+	set(frame*20, func(int) float64 { return 0.0035 * r.NormFloat64() })
+	// 同样轻的低频声音不算
+	set(frame*40, func(i int) float64 { return 0.005 * math.Sin(2*math.Pi*100*float64(i)/speechRate) })
+	// 响的声音
+	set(frame*60, func(i int) float64 { return 0.3 * math.Sin(2*math.Pi*300*float64(i)/speechRate) })
+
+	speech := detectSpeech(a, c)
+	for i, s := range speech {
+		want := (i >= 20 && i < 25) || (i >= 60 && i < 65)
+		if s != want {
+			t.Errorf("frame %d speech %v, want %v", i, s, want)
+		}
+	}
+}
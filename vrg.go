@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -17,17 +18,6 @@ import (
 	"time"
 )
 
-// var (
-// 	apiName     = flag.String("api_name", "", "API name to be used")
-// 	filePath    = flag.String("file_path", "", "File path to be used")
-// 	groupID     = flag.String("group_id", "", "Group ID to be used")
-// 	featureID   = flag.String("feature_id", "", "Feature ID to be used")
-// 	groupName   = flag.String("group_name", "", "Group name to be used")
-// 	groupInfo   = flag.String("group_info", "", "Group info to be used")
-// 	featureInfo = flag.String("feature_info", "", "Feature info to be used")
-// 	topK        = flag.Int("top_k", 0, "Search result top k to be used")
-// )
-
 type GenReqURL struct {
 	host string
 	path string
@@ -314,6 +304,7 @@ func genDeleteGroupReqBody(appId, groupId string) ([]byte, error) {
 }
 
 type reqInfo struct {
+	url         string
 	apiKey      string
 	apiSecret   string
 	appId       string
@@ -325,8 +316,15 @@ type reqInfo struct {
 	groupInfo   string
 	featureInfo string
 	topK        int
+	encoding    string // audio encoding, encodingLame or encodingRaw
 }
 
+// audio encodings of payload.resource
+const (
+	encodingLame = "lame" // mp3
+	encodingRaw  = "raw"  // 16 kHz mono s16le pcm
+)
+
 func genReqBody(r *reqInfo) ([]byte, error) {
 	apiName := r.apiName
 	appID := r.appId
@@ -337,6 +335,10 @@ func genReqBody(r *reqInfo) ([]byte, error) {
 	groupInfo := r.groupInfo
 	featureInfo := r.featureInfo
 	topK := r.topK
+	encoding := r.encoding
+	if encoding == "" {
+		encoding = encodingLame
+	}
 
 	if apiName == "createFeature" {
 		body := map[string]interface{}{
@@ -359,7 +361,7 @@ func genReqBody(r *reqInfo) ([]byte, error) {
 			},
 			"payload": map[string]interface{}{
 				"resource": map[string]interface{}{
-					"encoding":    "lame",
+					"encoding":    encoding,
 					"sample_rate": 16000,
 					"channels":    1,
 					"bit_depth":   16,
@@ -453,7 +455,7 @@ func genReqBody(r *reqInfo) ([]byte, error) {
 			},
 			"payload": map[string]interface{}{
 				"resource": map[string]interface{}{
-					"encoding":    "lame",
+					"encoding":    encoding,
 					"sample_rate": 16000,
 					"channels":    1,
 					"bit_depth":   16,
@@ -488,7 +490,7 @@ func genReqBody(r *reqInfo) ([]byte, error) {
 			},
 			"payload": map[string]interface{}{
 				"resource": map[string]interface{}{
-					"encoding":    "lame",
+					"encoding":    encoding,
 					"sample_rate": 16000,
 					"channels":    1,
 					"bit_depth":   16,
@@ -524,7 +526,7 @@ func genReqBody(r *reqInfo) ([]byte, error) {
 			},
 			"payload": map[string]interface{}{
 				"resource": map[string]interface{}{
-					"encoding":    "lame",
+					"encoding":    encoding,
 					"sample_rate": 16000,
 					"channels":    1,
 					"bit_depth":   16,
@@ -558,55 +560,63 @@ func genReqBody(r *reqInfo) ([]byte, error) {
 	return nil, fmt.Errorf("invalid api name")
 }
 
-func reqURL(r *reqInfo) (*result, int, error) {
+// reqURL calls the api of r with client, the request is canceled when ctx is done.
+func reqURL(ctx context.Context, client *http.Client, r *reqInfo) (*VoiceprintResult, error) {
 	apiName := r.apiName
 
 	genReqURL := &GenReqURL{}
 	body, err := genReqBody(r)
 	if err != nil {
-		return nil, -1, err
+		return nil, err
 	}
-	requestURL, err := genReqURL.assembleWSAuthURL("https://api.xf-yun.com/v1/private/s782b4996", r.apiKey, r.apiSecret, "POST")
+	requestURL, err := genReqURL.assembleWSAuthURL(r.url, r.apiKey, r.apiSecret, "POST")
 	if err != nil {
-		return nil, -1, err
+		return nil, err
 	}
-	log.Println(requestURL)
 
 	headers := map[string]string{
 		"content-type": "application/json",
-		"host":         "api.xf-yun.com",
+		"host":         genReqURL.host,
 		"appid":        r.appId,
 	}
-	request, err := http.NewRequest("POST", requestURL, bytes.NewBuffer(body))
+	request, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewBuffer(body))
 	if err != nil {
-		return nil, -1, err
+		return nil, err
 	}
 	for key, value := range headers {
 		request.Header.Set(key, value)
 	}
-	client := &http.Client{}
 	response, err := client.Do(request)
 	if err != nil {
-		return nil, -1, err
+		return nil, err
 	}
 	defer response.Body.Close()
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		return nil, -1, err
+		return nil, err
+	}
+	// 鉴权失败、限流等由网关返回，没有 header
+	if httpStatusError(response.StatusCode) != nil {
+		return nil, &httpError{Api: apiName, Status: response.StatusCode, Body: string(bytes.TrimSpace(responseBody))}
 	}
 	var tempResult map[string]interface{}
 	err = json.Unmarshal(responseBody, &tempResult)
 	if err != nil {
-		return nil, -1, err
+		return nil, err
 	}
 	log.Println(tempResult)
 
-	fcode := tempResult["header"].(map[string]interface{})["code"].(float64)
+	header, ok := tempResult["header"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %s: no header in response", apiName, response.Status)
+	}
+	fcode, _ := header["code"].(float64)
 	code := int(fcode)
 	if code != 0 {
-		err := errors.New(tempResult["header"].(map[string]interface{})["message"].(string))
-		log.Println("code:", code, "message:", err.Error())
-		return nil, code, err
+		message, _ := header["message"].(string)
+		sid, _ := header["sid"].(string)
+		log.Println("code:", code, "message:", message)
+		return nil, &xfError{Api: apiName, Code: code, Message: message, Sid: sid}
 	}
 
 	subject := ""
@@ -628,41 +638,50 @@ func reqURL(r *reqInfo) (*result, int, error) {
 	case "deleteGroup":
 		subject = "deleteGroupRes"
 	default:
-		return nil, -1, fmt.Errorf("invalid api name")
+		return nil, fmt.Errorf("invalid api name")
 	}
 
-	encodedText := tempResult["payload"].(map[string]interface{})[subject].(map[string]interface{})["text"].(string)
+	payload, _ := tempResult["payload"].(map[string]interface{})
+	subjectRes, _ := payload[subject].(map[string]interface{})
+	encodedText, ok := subjectRes["text"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w: no payload.%s.text", apiName, errBadResponse, subject)
+	}
 	decodedText, err := base64.StdEncoding.DecodeString(encodedText)
 	if err != nil {
-		return nil, -1, err
+		return nil, err
 	}
 	log.Println(string(decodedText))
 
-	res := &result{}
+	res := &VoiceprintResult{}
 
 	if apiName == "searchFea" {
 		response := &SearchFeaResponse{}
 		err := json.Unmarshal(decodedText, &response)
 		if err != nil {
 			log.Println("searchFee json decode error:", err)
-			return nil, -1, err
+			return nil, err
 		}
-		res.featureId = response.ScoreList[0].FeatureId
-		res.score = response.ScoreList[0].Score
+		// 分组里没有特征时列表为空
+		if len(response.ScoreList) == 0 {
+			return nil, fmt.Errorf("%s: %w: empty scoreList", apiName, errNoFeature)
+		}
+		res.FeatureId = response.ScoreList[0].FeatureId
+		res.Score = response.ScoreList[0].Score
 	} else if apiName == "searchScoreFea" {
 		response := &DearchScoreFeaResponse{}
 		err := json.Unmarshal(decodedText, &response)
 		if err != nil {
 			log.Println("searchScoreFea json decode error:", err)
-			return nil, -1, err
+			return nil, err
 		}
-		res.featureId = response.FeatureId
-		res.score = response.Score
+		res.FeatureId = response.FeatureId
+		res.Score = response.Score
 	}
 
-	log.Println("result:", res.featureId, res.score)
+	log.Println("result:", res.FeatureId, res.Score)
 
-	return res, 0, nil
+	return res, nil
 }
 
 // {
@@ -695,32 +714,3 @@ type DearchScoreFeaResponse struct {
 type SearchFeaResponse struct {
 	ScoreList []DearchScoreFeaResponse `json:"scoreList"`
 }
-
-// func main() {
-// 	appID := "f6e7d8fe"
-// 	apiSecret := "YmRiZjA5OGE1NmJlZGJhMWFhZDBkMWFk"
-// 	apiKey := "6c199ca711eb5007e52b5a13efe55c7b"
-// 	flag.Parse()
-// 	err := reqURL(*apiName, appID, apiKey, apiSecret, *filePath)
-// 	if err != nil {
-// 		log.Println(err)
-// 		os.Exit(1)
-// 	}
-// }
-
-type result struct {
-	featureId string
-	score     float64
-}
-
-func vrg(r *reqInfo) (*result, int, error) {
-	r.appId = "f6e7d8fe"
-	r.apiSecret = "YmRiZjA5OGE1NmJlZGJhMWFhZDBkMWFk"
-	r.apiKey = "6c199ca711eb5007e52b5a13efe55c7b"
-	r.topK = 1
-	r.groupInfo = r.groupId
-	r.groupName = r.groupId
-	log.Println(r.apiName, r.featureId, r.featureInfo)
-
-	return reqURL(r)
-}
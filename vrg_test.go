@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReqURLLog(t *testing.T) {
+	addr, err := startMock(mockScript{Features: []string{"0xabc"}, DefaultScore: 0.9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	r := &reqInfo{
+		url: "http://" + addr + "/v1/private/s782b4996", apiKey: "key", apiSecret: "secret", appId: "app",
+		apiName: "searchScoreFea", groupId: "group_test", featureId: "0xabc", audio: "audio", encoding: encodingRaw,
+	}
+	res, err := reqURL(context.Background(), http.DefaultClient, r)
+	if err != nil || res.FeatureId != "0xabc" || res.Score != 0.9 {
+		t.Fatalf("searchScoreFea: %+v %v", res, err)
+	}
+	// 请求的 url 带着签名
+	if s := buf.String(); strings.Contains(s, "authorization") || strings.Contains(s, "signature") {
+		t.Errorf("the signed request is logged:\n%s", s)
+	}
+}
+
+func TestGenReqBodyEncoding(t *testing.T) {
+	for _, api := range []string{"createFeature", "searchFea", "searchScoreFea", "updateFeature"} {
+		for encoding, want := range map[string]string{"": encodingLame, encodingLame: encodingLame, encodingRaw: encodingRaw} {
+			b, err := genReqBody(&reqInfo{apiName: api, appId: "app", groupId: "g", featureId: "f", topK: 1, audio: "YXVkaW8=", encoding: encoding})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body struct {
+				Payload struct {
+					Resource struct {
+						Encoding   string `json:"encoding"`
+						SampleRate int    `json:"sample_rate"`
+						Channels   int    `json:"channels"`
+						BitDepth   int    `json:"bit_depth"`
+						Audio      string `json:"audio"`
+					} `json:"resource"`
+				} `json:"payload"`
+			}
+			if err := json.Unmarshal(b, &body); err != nil {
+				t.Fatal(err)
+			}
+			r := body.Payload.Resource
+			if r.Encoding != want || r.SampleRate != 16000 || r.Channels != 1 || r.BitDepth != 16 || r.Audio != "YXVkaW8=" {
+				t.Errorf("%s with encoding %q: %+v", api, encoding, r)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The kinds of xfyun errors, xfError and iatError unwrap to one of them (or errNoFeature) by xfErrorCodes.
+var (
+	errXfAuth       = errors.New("xfyun authentication failed")
+	errXfQuota      = errors.New("xfyun quota exceeded")
+	errInvalidAudio = errors.New("audio rejected by xfyun")
+	errXfTransient  = errors.New("xfyun temporary failure")
+	errBadResponse  = errors.New("unexpected xfyun response")
+)
+
+// xfErrorCodes are the known codes of https://www.xfyun.cn/document/error-code, the others have no kind.
+var xfErrorCodes = map[int]error{
+	10105: errXfAuth,       // 没有权限
+	10313: errXfAuth,       // appid 错误
+	11200: errXfAuth,       // 功能未授权
+	10010: errXfQuota,      // 授权数已满
+	10110: errXfQuota,      // 无授权许可
+	11201: errXfQuota,      // 日调用量超限
+	10043: errInvalidAudio, // 音频解码失败
+	10019: errXfTransient,  // 读取数据超时
+	10114: errXfTransient,  // 会话超时
+	10200: errXfTransient,  // 读取数据超时
+	10700: errXfTransient,  // 引擎错误
+	11503: errXfTransient,  // 服务内部错误
+	23007: errNoFeature,    // 特征不存在
+	23008: errNoFeature,    // 特征库为空
+}
+
+// xfError is an error code in the header of a voiceprint api response.
+type xfError struct {
+	Api     string
+	Code    int
+	Message string
+	Sid     string
+}
+
+func (e *xfError) Error() string {
+	return fmt.Sprintf("%s error %d: %s (sid %s)", e.Api, e.Code, e.Message, e.Sid)
+}
+
+func (e *xfError) Unwrap() error {
+	return xfErrorCodes[e.Code]
+}
+
+// httpStatusError returns the kind of a failed http status of xfyun, nil if it has none.
+func httpStatusError(code int) error {
+	switch {
+	case code == 401 || code == 403:
+		return errXfAuth
+	case code == 429 || code >= 500:
+		return errXfTransient
+	}
+	return nil
+}
+
+// httpError is a failed http status of xfyun, returned by the gateway without a response header.
+type httpError struct {
+	Api    string
+	Status int
+	Body   string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("%s: http %d %s: %s", e.Api, e.Status, http.StatusText(e.Status), e.Body)
+}
+
+func (e *httpError) Unwrap() error {
+	return httpStatusError(e.Status)
+}
+
+// transient reports whether a call failing with err may succeed if it is made again.
+// A timeout of the http client is transient, retry stops anyway once the context of the caller is done.
+// Tls and proxy failures are not, they need the config or the network to be fixed.
+func transient(err error) bool {
+	if errors.Is(err, errXfTransient) {
+		return true
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "proxyconnect" {
+		return false
+	}
+	// 超时、连接被拒绝或被断开
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	var de *net.DNSError
+	if errors.As(err, &de) && de.Temporary() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var ce *websocket.CloseError
+	return errors.As(err, &ce) && ce.Code == websocket.CloseAbnormalClosure
+}
+
+// unsent reports whether a call failing with err surely had no effect, so even a call which is not
+// idempotent may be made again: xfyun answered with a temporary failure, or no connection was made.
+// A timeout or a broken connection is ambiguous, the request may have been applied.
+func unsent(err error) bool {
+	var xe *xfError
+	if errors.As(err, &xe) {
+		return errors.Is(err, errXfTransient)
+	}
+	var he *httpError
+	if errors.As(err, &he) {
+		return he.Status == http.StatusTooManyRequests || he.Status == http.StatusServiceUnavailable
+	}
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial" && errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// RetryConfig controls the retries of xfyun calls failing with a transient error.
+// The delay before retry n is random between half and all of min(BaseDelay * 2^n, MaxDelay).
+type RetryConfig struct {
+	Attempts  int           `yaml:"attempts"` // 包括第一次调用，1 不重试
+	BaseDelay time.Duration `yaml:"base_delay"`
+	MaxDelay  time.Duration `yaml:"max_delay"`
+}
+
+func (c RetryConfig) backoff(n int) time.Duration {
+	d := c.MaxDelay
+	if n < 30 && c.BaseDelay<<n < d {
+		d = c.BaseDelay << n
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retry calls f until it succeeds, fails with an error for which retryable (transient or unsent) is false
+// or Attempts are used up.
+func retry(ctx context.Context, c RetryConfig, api string, retryable func(error) bool, f func() error) error {
+	for n := 0; ; n++ {
+		err := f()
+		if err == nil || n+1 >= c.Attempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		d := c.backoff(n)
+		log.Println(api, "attempt", n+1, "failed:", err, "retry in", d)
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
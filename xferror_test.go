@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	c := RetryConfig{Attempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for n, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			if d := c.backoff(n); d < want/2 || d > want {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", n, d, want/2, want)
+			}
+		}
+	}
+	if d := c.backoff(100); d > time.Second {
+		t.Errorf("backoff(100) = %v", d)
+	}
+	if d := (RetryConfig{}).backoff(0); d != 0 {
+		t.Errorf("backoff without delays = %v", d)
+	}
+}
+
+func urlError(err error) error {
+	return &url.Error{Op: "Post", URL: "https://api.xf-yun.com/v1/private/s782b4996", Err: err}
+}
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		name              string
+		err               error
+		transient, unsent bool
+	}{
+		{"vendor code", &xfError{Api: "searchFea", Code: 11503}, true, true},
+		{"configuration code", &xfError{Api: "searchFea", Code: 11502}, false, false},
+		{"auth code", &xfError{Api: "searchFea", Code: 10313}, false, false},
+		{"no feature", &xfError{Api: "searchFea", Code: 23007}, false, false},
+		{"throttled", &httpError{Api: "searchFea", Status: 429}, true, true},
+		{"gateway timeout", &httpError{Api: "searchFea", Status: 504}, true, false},
+		{"forbidden", &httpError{Api: "searchFea", Status: 403}, false, false},
+		{"refused", urlError(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), true, true},
+		{"reset", urlError(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), true, false},
+		{"timeout", urlError(context.DeadlineExceeded), true, false},
+		{"eof", urlError(io.EOF), true, false},
+		{"proxy", urlError(&net.OpError{Op: "proxyconnect", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), false, false},
+		{"certificate", urlError(x509.UnknownAuthorityError{}), false, false},
+		{"bad response", fmt.Errorf("searchFea: %w: empty scoreList", errBadResponse), false, false},
+	}
+	for _, tt := range tests {
+		if got := transient(tt.err); got != tt.transient {
+			t.Errorf("%s: transient = %v, want %v", tt.name, got, tt.transient)
+		}
+		if got := unsent(tt.err); got != tt.unsent {
+			t.Errorf("%s: unsent = %v, want %v", tt.name, got, tt.unsent)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	c := RetryConfig{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	fail := func(errs ...error) (func() error, *int) {
+		n := 0
+		return func() error {
+			n++
+			if n > len(errs) {
+				return nil
+			}
+			return errs[n-1]
+		}, &n
+	}
+	busy := &xfError{Api: "searchFea", Code: 11503}
+	timeout := urlError(context.DeadlineExceeded)
+
+	f, n := fail(busy, busy)
+	if err := retry(context.Background(), c, "searchFea", transient, f); err != nil || *n != 3 {
+		t.Errorf("transient failures: err %v after %d calls", err, *n)
+	}
+	f, n = fail(busy, busy, busy, busy)
+	if err := retry(context.Background(), c, "searchFea", transient, f); !errors.Is(err, errXfTransient) || *n != 3 {
+		t.Errorf("attempts used up: err %v after %d calls", err, *n)
+	}
+	f, n = fail(&xfError{Api: "searchFea", Code: 10313})
+	if err := retry(context.Background(), c, "searchFea", transient, f); !errors.Is(err, errXfAuth) || *n != 1 {
+		t.Errorf("auth failure: err %v after %d calls", err, *n)
+	}
+	// 创建特征超时后不知道是否已经生效，不再调用
+	f, n = fail(timeout)
+	if err := retry(context.Background(), c, "createFeature", unsent, f); err != timeout || *n != 1 {
+		t.Errorf("ambiguous failure: err %v after %d calls", err, *n)
+	}
+	f, n = fail(busy)
+	if err := retry(context.Background(), c, "createFeature", unsent, f); err != nil || *n != 2 {
+		t.Errorf("unsent failure: err %v after %d calls", err, *n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f, n = fail(busy, busy)
+	if err := retry(ctx, c, "searchFea", transient, f); err != busy || *n != 1 {
+		t.Errorf("canceled: err %v after %d calls", err, *n)
+	}
+}